@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// AccessToken an access token with a label for logging
+type AccessToken struct {
+	Label string
+	Token string
+}
+
+// AccessTokens a list of accepted access tokens
+type AccessTokens []AccessToken
+
+// ParseAccessTokens parse comma separated tokens and comma separated "label:token" pairs,
+// unlabeled tokens are labeled "default", "default-2" and so on, if no token is given and open is true,
+// an empty token is accepted
+func ParseAccessTokens(tokens string, labeled string, open bool) (out AccessTokens) {
+	for _, t := range strings.Split(tokens, ",") {
+		if t = strings.TrimSpace(t); t == "" {
+			continue
+		}
+		label := "default"
+		if len(out) > 0 {
+			label += "-" + strconv.Itoa(len(out)+1)
+		}
+		out = append(out, AccessToken{Label: label, Token: t})
+	}
+	for _, pair := range strings.Split(labeled, ",") {
+		splits := strings.SplitN(pair, ":", 2)
+		if len(splits) != 2 {
+			continue
+		}
+		label, t := strings.TrimSpace(splits[0]), strings.TrimSpace(splits[1])
+		if label == "" || t == "" {
+			continue
+		}
+		out = append(out, AccessToken{Label: label, Token: t})
+	}
+	// keep the legacy behavior, an unset access token accepts empty token, unless another auth is configured
+	if len(out) == 0 && open {
+		out = append(out, AccessToken{Label: "default"})
+	}
+	return
+}
+
+// Match check request access token against all tokens in constant time, returns label of the matched one
+func (ts AccessTokens) Match(c echo.Context) (label string, ok bool) {
+	actual := []byte(accessToken(c))
+	for _, t := range ts {
+		if subtle.ConstantTimeCompare(actual, []byte(t.Token)) == 1 && !ok {
+			label, ok = t.Label, true
+		}
+	}
+	return
+}
+
+// accessTokenCookie name of the cookie remembering access token, configured by KB_TOKEN_COOKIE
+var accessTokenCookie = "kb_access_token"
+
+// formTokenPaths paths of html forms posting access token as a form value
+var formTokenPaths = map[string]bool{
+	"/search": true,
+}
+
+// accessToken extract access token from request, "Authorization: Bearer" header takes precedence over
+// query parameter, form value of formTokenPaths, then the cookie
+func accessToken(c echo.Context) string {
+	if h := c.Request().Header.Get(echo.HeaderAuthorization); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+	}
+	if t := c.QueryParam("access_token"); t != "" {
+		return t
+	}
+	if c.Request().Method == http.MethodPost && formTokenPaths[c.Path()] {
+		if t := c.FormValue("access_token"); t != "" {
+			return t
+		}
+	}
+	if cookie, err := c.Cookie(accessTokenCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// rememberAccessToken set the cookie if access token was given by query parameter, so following
+// navigation works without it
+func rememberAccessToken(c echo.Context, secure bool) {
+	if strings.HasPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ") {
+		return
+	}
+	t := c.QueryParam("access_token")
+	if t == "" {
+		return
+	}
+	if cookie, err := c.Cookie(accessTokenCookie); err == nil && cookie.Value == t {
+		return
+	}
+	c.SetCookie(&http.Cookie{
+		Name:     accessTokenCookie,
+		Value:    t,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// checkAccessToken compare request access token with expected one in constant time
+func checkAccessToken(c echo.Context, expected string) bool {
+	return subtle.ConstantTimeCompare([]byte(accessToken(c)), []byte(expected)) == 1
+}
+
+// BasicCredentials credentials of http basic auth, accepted as an alternative to access token
+type BasicCredentials struct {
+	User     string
+	Password string
+}
+
+// Enabled whether basic auth is configured
+func (bc BasicCredentials) Enabled() bool {
+	return bc.User != "" && bc.Password != ""
+}
+
+// Match check request basic auth credentials in constant time
+func (bc BasicCredentials) Match(c echo.Context) bool {
+	if !bc.Enabled() {
+		return false
+	}
+	user, password, ok := c.Request().BasicAuth()
+	if !ok {
+		return false
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(bc.User)) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(bc.Password)) == 1
+	return userOK && passwordOK
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type responseCacheEntry struct {
+	key     string
+	body    []byte
+	expires time.Time
+}
+
+// ResponseCache caches rendered responses by key for a ttl, least recently used entries are evicted
+// once size is reached
+type ResponseCache struct {
+	ttl     time.Duration
+	size    int
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+// NewResponseCache create a new ResponseCache holding at most size entries, ttl of 0 disables caching
+func NewResponseCache(ttl time.Duration, size int) *ResponseCache {
+	return &ResponseCache{ttl: ttl, size: size, lru: list.New(), entries: map[string]*list.Element{}}
+}
+
+// Get returns cached body if fresh
+func (rc *ResponseCache) Get(key string) (body []byte, ok bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	var el *list.Element
+	if el, ok = rc.entries[key]; !ok {
+		return
+	}
+	entry := el.Value.(*responseCacheEntry)
+	if time.Now().After(entry.expires) {
+		rc.lru.Remove(el)
+		delete(rc.entries, key)
+		ok = false
+		return
+	}
+	rc.lru.MoveToFront(el)
+	body = entry.body
+	return
+}
+
+// Set cache body under key, the least recently used entry is evicted if cache is full
+func (rc *ResponseCache) Set(key string, body []byte) {
+	if rc.ttl <= 0 || rc.size <= 0 {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	entry := &responseCacheEntry{key: key, body: body, expires: time.Now().Add(rc.ttl)}
+	if el, ok := rc.entries[key]; ok {
+		el.Value = entry
+		rc.lru.MoveToFront(el)
+		return
+	}
+	rc.entries[key] = rc.lru.PushFront(entry)
+	for rc.lru.Len() > rc.size {
+		el := rc.lru.Back()
+		rc.lru.Remove(el)
+		delete(rc.entries, el.Value.(*responseCacheEntry).key)
+	}
+}
+
+// Clear drop all cached entries
+func (rc *ResponseCache) Clear() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.lru.Init()
+	rc.entries = map[string]*list.Element{}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"strings"
+	"time"
+)
+
+// templateFuncs helpers available to all templates
+var templateFuncs = template.FuncMap{
+	"formatDate":    formatDate,
+	"truncate":      truncate,
+	"humanizeCount": humanizeCount,
+}
+
+// formatDate format a time.Time or an elasticsearch timestamp string with optional layout,
+// default layout is "2006-01-02 15:04", unparsable strings are returned as is
+func formatDate(v interface{}, layout ...string) string {
+	l := "2006-01-02 15:04"
+	if len(layout) > 0 {
+		l = layout[0]
+	}
+	switch t := v.(type) {
+	case time.Time:
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(l)
+	case string:
+		for _, p := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"} {
+			if parsed, err := time.Parse(p, t); err == nil {
+				return parsed.Format(l)
+			}
+		}
+		return t
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// truncate truncate s to at most n runes, takes s last so it works in pipelines, like {{.Body | truncate 100}}
+func truncate(n int, s string) string {
+	return snippet(s, n)
+}
+
+// humanizeCount format a count in short form, like 1.2k and 3.4M
+func humanizeCount(v interface{}) string {
+	var n float64
+	switch c := v.(type) {
+	case int:
+		n = float64(c)
+	case int64:
+		n = float64(c)
+	case float64:
+		n = c
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+	for _, unit := range []struct {
+		size   float64
+		suffix string
+	}{{1e9, "G"}, {1e6, "M"}, {1e3, "k"}} {
+		if n >= unit.size || n <= -unit.size {
+			return strings.TrimSuffix(fmt.Sprintf("%.1f", n/unit.size), ".0") + unit.suffix
+		}
+	}
+	return fmt.Sprintf("%.0f", n)
+}
@@ -1,6 +1,6 @@
 module github.com/guoyk93/kbase
 
-go 1.14
+go 1.16
 
 require (
 	github.com/labstack/echo/v4 v4.1.17
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// historyIndexMappings mappings of the history index, archived sources are stored but not indexed
+var historyIndexMappings = map[string]interface{}{
+	"properties": map[string]interface{}{
+		"doc_id":      map[string]interface{}{"type": "keyword"},
+		"index":       map[string]interface{}{"type": "keyword"},
+		"version":     map[string]interface{}{"type": "long"},
+		"archived_at": map[string]interface{}{"type": "date"},
+		"source":      map[string]interface{}{"type": "object", "enabled": false},
+	},
+}
+
+// HistoryEntry a past state of a document
+type HistoryEntry struct {
+	DocID      string          `json:"doc_id"`
+	Index      string          `json:"index"`
+	Version    int64           `json:"version"`
+	ArchivedAt time.Time       `json:"archived_at"`
+	Source     json.RawMessage `json:"source"`
+}
+
+// History archives past states of documents into a separate index
+type History struct {
+	client    *elastic.Client
+	index     string
+	retention time.Duration
+}
+
+// NewHistory create a new History, retention of 0 keeps history forever
+func NewHistory(client *elastic.Client, index string, retention time.Duration) *History {
+	return &History{client: client, index: index, retention: retention}
+}
+
+// Init create the history index if not exists
+func (h *History) Init(ctx context.Context) (err error) {
+	var exists bool
+	if exists, err = h.client.IndexExists(h.index).Do(ctx); err != nil || exists {
+		return
+	}
+	_, err = h.client.CreateIndex(h.index).BodyJson(map[string]interface{}{
+		"mappings": historyIndexMappings,
+	}).Do(ctx)
+	return
+}
+
+// Archive save current state of document id before it's changed, missing document is ignored,
+// entries older than retention are purged at the same time
+func (h *History) Archive(ctx context.Context, index string, id string) (err error) {
+	var res *elastic.GetResult
+	if res, err = h.client.Get().Index(index).Id(id).Do(ctx); err != nil {
+		if elastic.IsNotFound(err) {
+			err = nil
+		}
+		return
+	}
+	entry := HistoryEntry{
+		DocID:      id,
+		Index:      res.Index,
+		ArchivedAt: time.Now(),
+		Source:     res.Source,
+	}
+	if res.Version != nil {
+		entry.Version = *res.Version
+	}
+	if _, err = h.client.Index().Index(h.index).BodyJson(entry).Do(ctx); err != nil {
+		return
+	}
+	if h.retention > 0 {
+		_, err = h.client.DeleteByQuery(h.index).Query(
+			elastic.NewBoolQuery().Filter(
+				elastic.NewTermQuery("doc_id", id),
+				elastic.NewRangeQuery("archived_at").Lt(time.Now().Add(-h.retention)),
+			),
+		).Do(ctx)
+	}
+	return
+}
+
+// List past states of document id, newest first
+func (h *History) List(ctx context.Context, id string, size int) (entries []HistoryEntry, err error) {
+	var res *elastic.SearchResult
+	if res, err = h.client.Search(h.index).Query(
+		elastic.NewTermQuery("doc_id", id),
+	).Sort("archived_at", false).Size(size).IgnoreUnavailable(true).AllowNoIndices(true).Do(ctx); err != nil {
+		return
+	}
+	for _, hit := range res.Hits.Hits {
+		var entry HistoryEntry
+		if err = json.Unmarshal(hit.Source, &entry); err != nil {
+			return
+		}
+		entries = append(entries, entry)
+	}
+	return
+}
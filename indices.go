@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// IndexRev a knowledge base index with revision parsed from its name
+type IndexRev struct {
+	Index     string
+	Rev       int
+	DocsCount int
+	StoreSize string
+}
+
+// discoverIndices list all knowledge base indices, highest revision first, the first one is the active index
+func discoverIndices(ctx context.Context, client *elastic.Client, indexPrefix string) (indices []IndexRev, err error) {
+	var res elastic.CatIndicesResponse
+	if res, err = client.CatIndices().Do(ctx); err != nil {
+		return
+	}
+	for _, item := range res {
+		if !strings.HasPrefix(item.Index, indexPrefix) {
+			continue
+		}
+		if rev, err := strconv.Atoi(strings.TrimPrefix(item.Index, indexPrefix)); err == nil {
+			indices = append(indices, IndexRev{
+				Index:     item.Index,
+				Rev:       rev,
+				DocsCount: item.DocsCount,
+				StoreSize: item.StoreSize,
+			})
+		}
+	}
+	sort.Slice(indices, func(i, j int) bool {
+		return indices[i].Rev > indices[j].Rev
+	})
+	if len(indices) == 0 {
+		indices = append(indices, IndexRev{
+			Index: indexPrefix + "1",
+			Rev:   1,
+		})
+	}
+	return
+}
+
+// activeAlias name of the alias pointing to the active index
+func activeAlias(indexPrefix string) string {
+	return indexPrefix + "-active"
+}
+
+// IndexCache caches discovered indices and active index for a short ttl
+type IndexCache struct {
+	client    *elastic.Client
+	prefix    string
+	ttl       time.Duration
+	activeRev int
+	mu        sync.Mutex
+	indices   []IndexRev
+	active    string
+	target    IndexRev
+	expires   time.Time
+}
+
+// NewIndexCache create a new IndexCache, ttl of 0 disables caching, activeRev other than 0 overrides
+// the active index regardless of alias and highest revision
+func NewIndexCache(client *elastic.Client, prefix string, ttl time.Duration, activeRev int) *IndexCache {
+	return &IndexCache{client: client, prefix: prefix, ttl: ttl, activeRev: activeRev}
+}
+
+// load refresh the cache if expired, must be called with mu held
+func (ic *IndexCache) load(ctx context.Context) (err error) {
+	if time.Now().Before(ic.expires) {
+		return
+	}
+	var aliases *elastic.AliasesResult
+	if aliases, err = ic.client.Aliases().Index(ic.prefix + "*").Do(ctx); err != nil {
+		return
+	}
+	var indices []IndexRev
+	if indices, err = discoverIndices(ctx, ic.client, ic.prefix); err != nil {
+		return
+	}
+	ic.indices = indices
+	ic.active, ic.target = indices[0].Index, indices[0]
+	if targets := aliases.IndicesByAlias(activeAlias(ic.prefix)); len(targets) > 0 {
+		ic.active = activeAlias(ic.prefix)
+		for _, index := range indices {
+			if index.Index == targets[0] {
+				ic.target = index
+			}
+		}
+	}
+	if ic.activeRev > 0 {
+		ic.active = ic.prefix + strconv.Itoa(ic.activeRev)
+		ic.target = IndexRev{Index: ic.active, Rev: ic.activeRev}
+		for _, index := range indices {
+			if index.Rev == ic.activeRev {
+				ic.target = index
+			}
+		}
+	}
+	ic.expires = time.Now().Add(ic.ttl)
+	return
+}
+
+// Indices returns all knowledge base indices, highest revision first
+func (ic *IndexCache) Indices(ctx context.Context) (indices []IndexRev, err error) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	if err = ic.load(ctx); err != nil {
+		return
+	}
+	indices = ic.indices
+	return
+}
+
+// Active returns the active alias if exists, otherwise the highest revision index
+func (ic *IndexCache) Active(ctx context.Context) (index string, err error) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	if err = ic.load(ctx); err != nil {
+		return
+	}
+	index = ic.active
+	return
+}
+
+// ActiveRev returns the index the active alias points to, otherwise the highest revision index
+func (ic *IndexCache) ActiveRev(ctx context.Context) (index IndexRev, err error) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	if err = ic.load(ctx); err != nil {
+		return
+	}
+	index = ic.target
+	return
+}
+
+// Invalidate drop the cache, next call will rediscover
+func (ic *IndexCache) Invalidate() {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	ic.expires = time.Time{}
+}
+
+// revisionsCollapse collapse hits of all revisions by the stable doc_id field, every revision of a
+// document is kept as inner hits, so the newest one can be picked by newestRevision
+func revisionsCollapse(revisions int, highlight *elastic.Highlight) *elastic.CollapseBuilder {
+	// elasticsearch limits inner hits to 100 by default
+	if revisions > 100 {
+		revisions = 100
+	}
+	inner := elastic.NewInnerHit().Name("revisions").Size(revisions)
+	if highlight != nil {
+		inner = inner.Highlight(highlight)
+	}
+	return elastic.NewCollapseBuilder("doc_id.keyword").InnerHit(inner)
+}
+
+// newestRevision pick the hit from the highest revision among inner hits of a collapsed hit,
+// revisions are compared numerically, sorting by _index would put kb-rev10 before kb-rev9
+func newestRevision(hit *elastic.SearchHit, indexPrefix string) *elastic.SearchHit {
+	inner := hit.InnerHits["revisions"]
+	if inner == nil || inner.Hits == nil {
+		return hit
+	}
+	newest, newestRev := hit, -1
+	for _, h := range inner.Hits.Hits {
+		if rev, err := strconv.Atoi(strings.TrimPrefix(h.Index, indexPrefix)); err == nil && rev > newestRev {
+			newest, newestRev = h, rev
+		}
+	}
+	return newest
+}
+
+// indexSettingsUnsafe index settings generated by elasticsearch or specific to an existing index,
+// they can not be used to create a new index
+var indexSettingsUnsafe = []string{"uuid", "version", "creation_date", "provided_name", "blocks", "resize", "routing"}
+
+// copyIndexBody build the create index body with settings and mappings of an existing index
+func copyIndexBody(ctx context.Context, client *elastic.Client, index string) (body map[string]interface{}, err error) {
+	var res map[string]*elastic.IndicesGetResponse
+	if res, err = client.IndexGet(index).Do(ctx); err != nil {
+		return
+	}
+	info := res[index]
+	if info == nil {
+		err = errors.New("index " + index + " not found")
+		return
+	}
+	body = map[string]interface{}{}
+	if settings, ok := info.Settings["index"].(map[string]interface{}); ok {
+		for _, key := range indexSettingsUnsafe {
+			delete(settings, key)
+		}
+		body["settings"] = map[string]interface{}{"index": settings}
+	}
+	if len(info.Mappings) > 0 {
+		body["mappings"] = info.Mappings
+	}
+	return
+}
+
+// initialIndexMappings mappings of the first index, text fields also have keyword sub fields like dynamic mapping
+var initialIndexMappings = map[string]interface{}{
+	"properties": map[string]interface{}{
+		"kind": map[string]interface{}{"type": "keyword"},
+		"title": map[string]interface{}{
+			"type":   "text",
+			"fields": map[string]interface{}{"keyword": map[string]interface{}{"type": "keyword", "ignore_above": 256}},
+		},
+		"body":       map[string]interface{}{"type": "text"},
+		"created_at": map[string]interface{}{"type": "date"},
+		"doc_id": map[string]interface{}{
+			"type":   "text",
+			"fields": map[string]interface{}{"keyword": map[string]interface{}{"type": "keyword", "ignore_above": 256}},
+		},
+	},
+}
+
+// loadIndexMappings load mappings of revision indices from a json file, initialIndexMappings is used if file is empty
+func loadIndexMappings(file string) (mappings map[string]interface{}, err error) {
+	if file == "" {
+		mappings = initialIndexMappings
+		return
+	}
+	var buf []byte
+	if buf, err = os.ReadFile(file); err != nil {
+		return
+	}
+	if err = json.Unmarshal(buf, &mappings); err != nil {
+		err = fmt.Errorf("invalid mappings file %s: %w", file, err)
+		return
+	}
+	if _, ok := mappings["properties"]; !ok {
+		err = fmt.Errorf("invalid mappings file %s: missing properties", file)
+	}
+	return
+}
+
+// indexTemplateName name of the index template of revision indices
+func indexTemplateName(indexPrefix string) string {
+	return indexPrefix + "-template"
+}
+
+// putIndexTemplate create or update the index template matching all revision indices, so indices created
+// by anything else than /admin/init get the standard mappings too
+func putIndexTemplate(ctx context.Context, client *elastic.Client, indexPrefix string, mappings map[string]interface{}) (err error) {
+	_, err = client.IndexPutTemplate(indexTemplateName(indexPrefix)).BodyJson(map[string]interface{}{
+		"index_patterns": []string{indexPrefix + "*"},
+		"mappings":       mappings,
+	}).Do(ctx)
+	return
+}
+
+// moveActiveAlias point the active alias to index in a single atomic action, returns indices it pointed to before
+func moveActiveAlias(ctx context.Context, client *elastic.Client, indexPrefix string, index string) (previous []string, err error) {
+	alias := activeAlias(indexPrefix)
+	var aliases *elastic.AliasesResult
+	if aliases, err = client.Aliases().Index(indexPrefix + "*").Do(ctx); err != nil {
+		return
+	}
+	action := client.Alias().Add(index, alias)
+	for _, p := range aliases.IndicesByAlias(alias) {
+		if p != index {
+			action = action.Remove(p, alias)
+		}
+		previous = append(previous, p)
+	}
+	_, err = action.Do(ctx)
+	return
+}
+
+// snapshotIndex snapshot a single index into repository and wait for completion, returns name of the snapshot
+func snapshotIndex(ctx context.Context, client *elastic.Client, repository string, index string) (name string, err error) {
+	name = index + "-" + strings.ToLower(time.Now().UTC().Format("20060102t150405z"))
+	var res *elastic.SnapshotCreateResponse
+	if res, err = client.SnapshotCreate(repository, name).BodyJson(map[string]interface{}{
+		"indices":              index,
+		"include_global_state": false,
+	}).WaitForCompletion(true).Do(ctx); err != nil {
+		return
+	}
+	if res.Snapshot == nil || res.Snapshot.State != "SUCCESS" {
+		state := "unknown"
+		if res.Snapshot != nil {
+			state = res.Snapshot.State
+		}
+		err = fmt.Errorf("snapshot %s of %s finished with state %s", name, index, state)
+	}
+	return
+}
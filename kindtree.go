@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// KindNode a level of hierarchical kind names, count includes all kinds under it
+type KindNode struct {
+	Name     string      `json:"name"`
+	Path     string      `json:"path"`
+	Count    int64       `json:"count"`
+	IsKind   bool        `json:"is_kind"`
+	URL      string      `json:"-"`
+	Children []*KindNode `json:"children,omitempty"`
+}
+
+// buildKindTree split kind names by sep into a tree, nodes are sorted by name,
+// link builds url of a node which is a kind itself, can be nil
+func buildKindTree(kinds []KindCount, sep string, link func(kind string) string) (roots []*KindNode) {
+	byPath := map[string]*KindNode{}
+	for _, kind := range kinds {
+		var path string
+		siblings := &roots
+		for i, name := range strings.Split(kind.Kind, sep) {
+			if i > 0 {
+				path += sep
+			}
+			path += name
+			node := byPath[path]
+			if node == nil {
+				node = &KindNode{Name: name, Path: path}
+				byPath[path] = node
+				*siblings = append(*siblings, node)
+			}
+			node.Count += kind.Count
+			siblings = &node.Children
+		}
+		node := byPath[kind.Kind]
+		node.IsKind = true
+		if link != nil {
+			node.URL = link(kind.Kind)
+		}
+	}
+	sortKindNodes(roots)
+	return
+}
+
+// sortKindNodes sort nodes by name recursively
+func sortKindNodes(nodes []*KindNode) {
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Name < nodes[j].Name
+	})
+	for _, node := range nodes {
+		sortKindNodes(node.Children)
+	}
+}
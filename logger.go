@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel severity of a log entry
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+var logLevelNames = map[LogLevel]string{
+	LogLevelDebug: "debug",
+	LogLevelInfo:  "info",
+	LogLevelWarn:  "warn",
+	LogLevelError: "error",
+}
+
+// ParseLogLevel parse one of debug, info, warn and error
+func ParseLogLevel(s string) (LogLevel, error) {
+	for level, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return level, nil
+		}
+	}
+	return LogLevelInfo, fmt.Errorf("unknown log level: %s", s)
+}
+
+// Logger leveled logger writing plain text or json lines
+type Logger struct {
+	mu    sync.Mutex
+	out   io.Writer
+	level LogLevel
+	json  bool
+}
+
+// NewLogger create a new Logger, entries below level are discarded
+func NewLogger(out io.Writer, level LogLevel, json bool) *Logger {
+	return &Logger{out: out, level: level, json: json}
+}
+
+var logger = NewLogger(os.Stderr, LogLevelInfo, false)
+
+func (l *Logger) log(level LogLevel, msg string, kvs ...interface{}) {
+	if level < l.level {
+		return
+	}
+	now := time.Now()
+	var line []byte
+	if l.json {
+		entry := map[string]interface{}{
+			"time":  now.Format(time.RFC3339Nano),
+			"level": logLevelNames[level],
+			"msg":   msg,
+		}
+		for i := 0; i+1 < len(kvs); i += 2 {
+			entry[fmt.Sprintf("%v", kvs[i])] = logValue(kvs[i+1])
+		}
+		line, _ = json.Marshal(entry)
+	} else {
+		sb := &strings.Builder{}
+		sb.WriteString(now.Format("2006/01/02 15:04:05 "))
+		sb.WriteString(strings.ToUpper(logLevelNames[level]))
+		sb.WriteString(" ")
+		sb.WriteString(msg)
+		for i := 0; i+1 < len(kvs); i += 2 {
+			fmt.Fprintf(sb, " %v=%v", kvs[i], logValue(kvs[i+1]))
+		}
+		line = []byte(sb.String())
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.out.Write(append(line, '\n'))
+}
+
+// logValue convert errors and stringers to strings, so they are readable in json
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+// Debug log at debug level with key value pairs
+func (l *Logger) Debug(msg string, kvs ...interface{}) { l.log(LogLevelDebug, msg, kvs...) }
+
+// Info log at info level with key value pairs
+func (l *Logger) Info(msg string, kvs ...interface{}) { l.log(LogLevelInfo, msg, kvs...) }
+
+// Warn log at warn level with key value pairs
+func (l *Logger) Warn(msg string, kvs ...interface{}) { l.log(LogLevelWarn, msg, kvs...) }
+
+// Error log at error level with key value pairs
+func (l *Logger) Error(msg string, kvs ...interface{}) { l.log(LogLevelError, msg, kvs...) }
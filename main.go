@@ -1,19 +1,32 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"embed"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/olivere/elastic/v7"
 	"html/template"
 	"io"
-	"log"
+	"io/fs"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -21,161 +34,3033 @@ import (
 	"github.com/labstack/echo/v4/middleware"
 )
 
-const indexPrefix = "kb-rev"
+const (
+	defaultIndexPrefix = "kb-rev"
+	maxSearchSize      = 100
+	// maxResultWindow default index.max_result_window of elasticsearch, deeper from + size is rejected
+	maxResultWindow = 10000
+	// maxBulkErrors max error messages returned by /api/bulk, further failures are only counted
+	maxBulkErrors = 100
+	// maxKindAggSize upper bound of kinds aggregation size, within default search.max_buckets of elasticsearch
+	maxKindAggSize = 10000
+	// maxHomeCacheEntries max home page variants cached, least recently used ones are evicted
+	maxHomeCacheEntries = 100
+)
+
+//go:embed views/*.gohtml
+var embeddedViews embed.FS
+
+//go:embed assets
+var embeddedAssets embed.FS
+
+// assetsFileSystem serve assets from dir, fallback to embedded assets if dir not exists
+func assetsFileSystem(dir string) http.FileSystem {
+	if info, err := os.Stat(dir); err == nil && info.IsDir() {
+		return http.Dir(dir)
+	}
+	sub, _ := fs.Sub(embeddedAssets, "assets")
+	return http.FS(sub)
+}
+
+// loadTemplates parse templates from dir with funcs, fallback to embedded views if dir not exists
+func loadTemplates(dir string, funcs template.FuncMap) (*template.Template, error) {
+	if info, err := os.Stat(dir); err == nil && info.IsDir() {
+		return template.New("").Funcs(funcs).ParseGlob(filepath.Join(dir, "*.gohtml"))
+	}
+	return template.New("").Funcs(funcs).ParseFS(embeddedViews, "views/*.gohtml")
+}
 
+// Renderer renders templates, templates can be reloaded concurrently with rendering
 type Renderer struct {
+	mu        sync.RWMutex
 	templates *template.Template
+	banner    string
+}
+
+// Banner current banner message shown on every page, empty for none
+func (r *Renderer) Banner() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.banner
+}
+
+// SetBanner update banner message at runtime
+func (r *Renderer) SetBanner(banner string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.banner = banner
+}
+
+// Loaded whether templates are loaded
+func (r *Renderer) Loaded() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.templates != nil
+}
+
+// Reload parse templates from dir again, existing templates are kept if parsing failed
+func (r *Renderer) Reload(dir string) (err error) {
+	funcs := template.FuncMap{"banner": r.Banner}
+	for name, fn := range templateFuncs {
+		funcs[name] = fn
+	}
+	var templates *template.Template
+	if templates, err = loadTemplates(dir, funcs); err != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.templates = templates
+	return
+}
+
+// Has whether a template with name is defined
+func (r *Renderer) Has(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.templates != nil && r.templates.Lookup(name) != nil
 }
 
 func (r *Renderer) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
-	if r.templates == nil {
+	// parsed templates are never modified, only replaced, so it's safe to execute without lock
+	r.mu.RLock()
+	templates := r.templates
+	r.mu.RUnlock()
+	if templates == nil {
 		return errors.New("renderer not initialized")
 	}
-	return r.templates.ExecuteTemplate(w, name, data)
+	return templates.ExecuteTemplate(w, name, data)
 }
 
-func exit(err *error) {
-	if *err != nil {
-		log.Println("exited with error:", (*err).Error())
-		os.Exit(1)
-	} else {
-		log.Println("exited")
+var (
+	// probePaths paths of liveness and readiness probes
+	probePaths = map[string]bool{
+		"/livez":   true,
+		"/readyz":  true,
+		"/healthz": true,
+	}
+	// homeCacheParams query params read by home page, other params are left out of the cache key
+	homeCacheParams = []string{"access_token", "kind_prefix", "page", "per_page", "from", "kind_agg_size", "limit"}
+	// readOnlySafePaths paths accepting POST without writing anything, allowed in read-only mode
+	readOnlySafePaths = map[string]bool{
+		"/search":  true,
+		"/preview": true,
+	}
+	// longRunningPaths streaming endpoints and admin operations which may run for long, like reindex and snapshot,
+	// exempted from request timeout
+	longRunningPaths = map[string]bool{
+		"/api/export":       true,
+		"/api/bulk":         true,
+		"/admin/reindex":    true,
+		"/admin/index/:rev": true,
+	}
+	// publicPaths paths exempted from access token
+	publicPaths = map[string]bool{
+		"/":         true,
+		"/assets/*": true,
+		"/livez":    true,
+		"/readyz":   true,
+		"/healthz":  true,
+		"/metrics":  true,
+	}
+)
+
+var accessTokenPattern = regexp.MustCompile(`access_token=[^&\s"]*`)
+
+// RedactWriter writer redacting access_token query parameters
+type RedactWriter struct {
+	Writer io.Writer
+}
+
+func (w *RedactWriter) Write(p []byte) (n int, err error) {
+	if _, err = w.Writer.Write(accessTokenPattern.ReplaceAll(p, []byte("access_token=REDACTED"))); err != nil {
+		return
 	}
+	n = len(p)
+	return
 }
 
-func main() {
-	var err error
-	defer exit(&err)
+// Doc a knowledge base document
+type Doc struct {
+	Kind      string `json:"kind"`
+	Title     string `json:"title"`
+	Body      string `json:"body"`
+	CreatedAt string `json:"created_at,omitempty"`
+	DocID     string `json:"doc_id,omitempty"`
+}
 
-	var (
-		envElasticsearchURL      = strings.TrimSpace(os.Getenv("KB_ELASTICSEARCH_URL"))
-		envElasticsearchUsername = strings.TrimSpace(os.Getenv("KB_ELASTICSEARCH_USERNAME"))
-		envElasticsearchPassword = strings.TrimSpace(os.Getenv("KB_ELASTICSEARCH_PASSWORD"))
-		envAccessToken           = strings.TrimSpace(os.Getenv("KB_ACCESS_TOKEN"))
-		envBind                  = strings.TrimSpace(os.Getenv("KB_BIND"))
-		envDebug, _              = strconv.ParseBool(strings.TrimSpace(os.Getenv("KB_DEBUG")))
-	)
+// Validate trim and check required fields
+func (d *Doc) Validate() error {
+	if d.Kind = strings.TrimSpace(d.Kind); d.Kind == "" {
+		return errors.New("missing kind")
+	}
+	if d.Title = strings.TrimSpace(d.Title); d.Title == "" {
+		return errors.New("missing title")
+	}
+	return nil
+}
+
+// newDocID generate a random document id in the same format as elasticsearch auto generated ids,
+// so the stable doc_id can be set before the document is indexed
+func newDocID() (string, error) {
+	buf := make([]byte, 15)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
 
-	_ = envElasticsearchURL
+// SearchHit a hit in search page
+type SearchHit struct {
+	ID      string
+	Kind    string
+	Title   template.HTML
+	Snippet template.HTML
+	URL     string
+}
 
-	var client *elastic.Client
+// SearchFacet a kind facet in search page
+type SearchFacet struct {
+	Kind   string
+	Count  int64
+	URL    string
+	Active bool
+}
 
-	{
-		opts := []elastic.ClientOptionFunc{
-			elastic.SetURL(envElasticsearchURL),
-			elastic.SetSniff(false),
-		}
-		if envElasticsearchUsername != "" && envElasticsearchPassword != "" {
-			opts = append(opts, elastic.SetBasicAuth(envElasticsearchUsername, envElasticsearchPassword))
+// IndexCount count of hits from an index
+type IndexCount struct {
+	Index string `json:"index"`
+	Count int64  `json:"count"`
+}
+
+// newIndexCountsAggregation count hits by index, before collapsing, so stale revisions are visible
+func newIndexCountsAggregation() elastic.Aggregation {
+	return elastic.NewTermsAggregation().Field("_index").Size(100)
+}
+
+// indexCounts extract hit counts by index from aggregation named "indices"
+func indexCounts(res *elastic.SearchResult) (counts []IndexCount) {
+	counts = []IndexCount{}
+	if items, _ := res.Aggregations.Terms("indices"); items != nil {
+		for _, bucket := range items.Buckets {
+			counts = append(counts, IndexCount{
+				Index: fmt.Sprintf("%v", bucket.Key),
+				Count: bucket.DocCount,
+			})
 		}
+	}
+	return
+}
+
+// SearchData data of search page
+type SearchData struct {
+	AccessToken string
+	Query       string
+	FromDate    string
+	ToDate      string
+	Sort        string
+	Kind        string
+	Fuzzy       bool
+	AllRevs     bool
+	Suggestion  string
+	SuggestURL  string
+	Total       int64
+	Hits        []SearchHit
+	Facets      []SearchFacet
+	Indices     []IndexCount
+	AllKindsURL string
+}
 
-		if client, err = elastic.Dial(opts...); err != nil {
+// RecentDoc a document in recent list
+type RecentDoc struct {
+	ID        string `json:"id"`
+	Kind      string `json:"kind"`
+	Title     string `json:"title"`
+	CreatedAt string `json:"created_at,omitempty"`
+	URL       string `json:"-"`
+}
+
+// recentDocs list latest documents by created_at, documents without created_at come last in reverse _seq_no order
+func recentDocs(ctx context.Context, client *elastic.Client, index string, limit int) (docs []RecentDoc, err error) {
+	var res *elastic.SearchResult
+	if res, err = client.Search(index).Preference(searchPreference).SortBy(
+		elastic.NewFieldSort("created_at").Desc().Missing("_last").UnmappedType("date"),
+		elastic.NewFieldSort("_seq_no").Desc(),
+	).Size(limit).Do(ctx); err != nil {
+		return
+	}
+	docs = []RecentDoc{}
+	for _, hit := range res.Hits.Hits {
+		var doc Doc
+		if err = json.Unmarshal(hit.Source, &doc); err != nil {
 			return
 		}
+		docs = append(docs, RecentDoc{
+			ID:        hit.Id,
+			Kind:      doc.Kind,
+			Title:     doc.Title,
+			CreatedAt: doc.CreatedAt,
+		})
 	}
+	return
+}
 
-	renderer := &Renderer{}
+// encodeCursor encode sort values of the last hit as an opaque search_after cursor
+func encodeCursor(values []interface{}) (string, error) {
+	buf, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
 
-	_ = client
+// decodeCursor decode a search_after cursor, numbers are kept as is to not lose precision of long values
+func decodeCursor(cursor string) (values []interface{}, err error) {
+	var buf []byte
+	if buf, err = base64.RawURLEncoding.DecodeString(cursor); err == nil {
+		dec := json.NewDecoder(bytes.NewReader(buf))
+		dec.UseNumber()
+		err = dec.Decode(&values)
+	}
+	if err != nil || len(values) == 0 {
+		err = echo.NewHTTPError(http.StatusBadRequest, "invalid cursor")
+	}
+	return
+}
 
-	e := echo.New()
-	e.Debug = envDebug
-	e.HideBanner = true
-	e.HidePort = true
-	e.Renderer = renderer
-	e.Use(middleware.Recover())
-	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
-		return func(c echo.Context) error {
-			if c.Path() != "/" && c.QueryParam("access_token") != envAccessToken {
-				return c.String(http.StatusForbidden, "invalid access_token")
-			} else {
-				return next(c)
-			}
-		}
+// DocField a field shown on document page
+type DocField struct {
+	Name  string
+	Value string
+}
+
+// DocPage data of document page, also used by preview
+type DocPage struct {
+	ID         string
+	Index      string
+	Kind       string
+	Fields     []DocField
+	Source     map[string]interface{}
+	HistoryURL string
+	Similar    []SimilarDoc
+	Preview    bool
+	Error      string
+}
+
+// newDocPage build document page from source, fields are sorted by name
+func newDocPage(id string, index string, source map[string]interface{}) DocPage {
+	page := DocPage{ID: id, Index: index, Source: source}
+	page.Kind, _ = source["kind"].(string)
+	for k, v := range source {
+		page.Fields = append(page.Fields, DocField{
+			Name:  k,
+			Value: fmt.Sprintf("%v", v),
+		})
+	}
+	sort.Slice(page.Fields, func(i, j int) bool {
+		return page.Fields[i].Name < page.Fields[j].Name
 	})
-	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
-		return func(c echo.Context) error {
-			if renderer.templates == nil || envDebug {
-				renderer.templates = template.Must(template.ParseGlob("views/*.gohtml"))
-			}
-			return next(c)
+	return page
+}
+
+// SimilarDoc a document similar to another one
+type SimilarDoc struct {
+	ID    string `json:"id"`
+	Kind  string `json:"kind"`
+	Title string `json:"title"`
+	URL   string `json:"-"`
+}
+
+// similarDocs find documents similar to document id by title and body, the document itself is excluded
+func similarDocs(ctx context.Context, client *elastic.Client, index string, id string, size int) (docs []SimilarDoc, err error) {
+	var res *elastic.SearchResult
+	if res, err = client.Search(index).Preference(searchPreference).Query(
+		elastic.NewMoreLikeThisQuery().Field("title", "body").LikeItems(
+			elastic.NewMoreLikeThisQueryItem().Index(index).Id(id),
+		).MinTermFreq(1).MinDocFreq(1),
+	).Size(size).Do(ctx); err != nil {
+		return
+	}
+	docs = []SimilarDoc{}
+	for _, hit := range res.Hits.Hits {
+		var doc Doc
+		if err = json.Unmarshal(hit.Source, &doc); err != nil {
+			return
 		}
-	})
-	e.GET("/", func(c echo.Context) (err error) {
-		type DataIndex struct {
-			Index string
-			Rev   int
+		docs = append(docs, SimilarDoc{
+			ID:    hit.Id,
+			Kind:  doc.Kind,
+			Title: doc.Title,
+		})
+	}
+	return
+}
+
+// Paging pagination parsed from query params
+type Paging struct {
+	Size int
+	From int
+	Page int
+}
+
+// parsePaging parse page size from sizeParam, and offset from query param from or page,
+// size defaults to defaultSize and must be within 1 to maxSize, from must not be negative, page starts from 1
+func parsePaging(c echo.Context, sizeParam string, defaultSize, maxSize int) (p Paging, err error) {
+	p.Size, p.Page = defaultSize, 1
+	if v := c.QueryParam(sizeParam); v != "" {
+		if p.Size, err = strconv.Atoi(v); err != nil || p.Size < 1 || p.Size > maxSize {
+			err = echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid %s %q, expecting 1 to %d", sizeParam, v, maxSize))
+			return
 		}
-		type DataKind struct {
-			Kind  string
-			Count int64
+	}
+	if v := c.QueryParam("from"); v != "" {
+		if p.From, err = strconv.Atoi(v); err != nil || p.From < 0 {
+			err = echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid from %q, expecting a non-negative integer", v))
+			return
 		}
-		type Data struct {
-			Kinds   []DataKind
-			Indices []DataIndex
+		p.Page = p.From/p.Size + 1
+	} else if v := c.QueryParam("page"); v != "" {
+		if p.Page, err = strconv.Atoi(v); err != nil || p.Page < 1 {
+			err = echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid page %q, expecting a positive integer", v))
+			return
 		}
-		var data Data
-		{
-			var res elastic.CatIndicesResponse
-			if res, err = client.CatIndices().Do(c.Request().Context()); err != nil {
-				return
-			}
-			for _, item := range res {
-				if !strings.HasPrefix(item.Index, indexPrefix) {
-					continue
-				}
-				if rev, err := strconv.Atoi(strings.TrimPrefix(item.Index, indexPrefix)); err == nil {
-					data.Indices = append(data.Indices, DataIndex{
-						Index: item.Index,
-						Rev:   rev,
-					})
-				}
-			}
-			sort.Slice(data.Indices, func(i, j int) bool {
-				return data.Indices[i].Rev > data.Indices[j].Rev
+		p.From = (p.Page - 1) * p.Size
+	}
+	if p.From+p.Size > maxResultWindow {
+		err = echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf(
+			"result window too large, from + size must not exceed %d, please narrow down the query", maxResultWindow,
+		))
+		return
+	}
+	return
+}
+
+// KindCount document count of a kind
+type KindCount struct {
+	Kind  string `json:"kind"`
+	Count int64  `json:"count"`
+}
+
+// aggregateKinds count documents by kind with a terms aggregation, optionally scoped by query,
+// truncated is true if there are more kinds than size
+func aggregateKinds(ctx context.Context, client *elastic.Client, index string, query elastic.Query, size int) (kinds []KindCount, truncated bool, err error) {
+	search := client.Search(index).Preference(searchPreference).IgnoreUnavailable(true).AllowNoIndices(true).Size(0).Aggregation(
+		"kinds", elastic.NewTermsAggregation().Field("kind").Size(size),
+	)
+	if query != nil {
+		search = search.Query(query)
+	}
+	var res *elastic.SearchResult
+	if err = retryTransient(ctx, func() (err error) {
+		res, err = search.Do(ctx)
+		return
+	}); err != nil {
+		// a fresh cluster has no index at all, treat it as no documents
+		if elastic.IsNotFound(err) {
+			err = nil
+		}
+		return
+	}
+	if items, _ := res.Aggregations.Terms("kinds"); items != nil {
+		truncated = items.SumOfOtherDocCount > 0
+		for _, bucket := range items.Buckets {
+			kinds = append(kinds, KindCount{
+				Kind:  fmt.Sprintf("%v", bucket.Key),
+				Count: bucket.DocCount,
 			})
-			if len(data.Indices) == 0 {
-				data.Indices = append(data.Indices, DataIndex{
-					Index: indexPrefix + "1",
-					Rev:   1,
-				})
-			}
 		}
-		{
-			var res *elastic.SearchResult
-			if res, err = client.Search("kb-*").Size(0).Aggregation(
-				"kinds", elastic.NewTermsAggregation().Field("kind").Size(9999),
-			).Do(c.Request().Context()); err != nil {
+	}
+	return
+}
+
+// searchFields fields with optional caret boosts searched by bare text, configured by KB_SEARCH_FIELDS
+var searchFields = []string{"title^2", "body"}
+
+// searchPreference preference of search requests for shard cache locality, like "_local" or a custom string,
+// configured by KB_SEARCH_PREFERENCE, empty for elasticsearch default
+var searchPreference string
+
+// parseSearchFields parse comma separated fields with optional caret boosts, like "title^3,body"
+func parseSearchFields(s string) (fields []string, err error) {
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		splits := strings.SplitN(field, "^", 2)
+		if strings.TrimSpace(splits[0]) == "" {
+			err = fmt.Errorf("invalid KB_SEARCH_FIELDS %q, missing field name", field)
+			return
+		}
+		if len(splits) == 2 {
+			if _, err = strconv.ParseFloat(splits[1], 64); err != nil {
+				err = fmt.Errorf("invalid KB_SEARCH_FIELDS %q, boost must be a number", field)
 				return
 			}
+		}
+		fields = append(fields, field)
+	}
+	if len(fields) == 0 {
+		err = errors.New("invalid KB_SEARCH_FIELDS, no field")
+	}
+	return
+}
 
-			if items, _ := res.Aggregations.Terms("kinds"); items != nil {
-				for _, bucket := range items.Buckets {
-					data.Kinds = append(data.Kinds, DataKind{
-						Kind:  fmt.Sprintf("%v", bucket.Key),
-						Count: bucket.DocCount,
-					})
-				}
+// searchFieldPrefixes field prefixes supported in search syntax, "title:" and "body:" match on the text field,
+// "kind:" filters exactly on kind, any other prefix is treated as literal text
+var searchFieldPrefixes = []string{"title", "body", "kind"}
+
+// parseSearchSyntax split q into bare text and field scoped terms
+func parseSearchSyntax(q string) (text string, fields map[string][]string) {
+	fields = map[string][]string{}
+	var bare []string
+	for _, term := range strings.Fields(q) {
+		var scoped bool
+		for _, field := range searchFieldPrefixes {
+			if value := strings.TrimPrefix(term, field+":"); value != term && value != "" {
+				fields[field] = append(fields[field], value)
+				scoped = true
+				break
 			}
 		}
-		return c.Render(http.StatusOK, "index", data)
-	})
+		if !scoped {
+			bare = append(bare, term)
+		}
+	}
+	text = strings.Join(bare, " ")
+	return
+}
 
-	chErr := make(chan error, 1)
-	chSig := make(chan os.Signal, 1)
-	signal.Notify(chSig, syscall.SIGTERM, syscall.SIGINT)
+// newSearchQuery build the full-text query shared by html and json search, with optional filters
+func newSearchQuery(q string, fuzzy bool, filters ...elastic.Query) elastic.Query {
+	text, fields := parseSearchSyntax(q)
+	query := elastic.NewBoolQuery()
+	if text != "" {
+		mm := elastic.NewMultiMatchQuery(text, searchFields...)
+		if fuzzy {
+			mm = mm.Fuzziness("AUTO")
+		}
+		query = query.Must(mm)
+	}
+	for _, field := range []string{"title", "body"} {
+		for _, value := range fields[field] {
+			m := elastic.NewMatchQuery(field, value)
+			if fuzzy {
+				m = m.Fuzziness("AUTO")
+			}
+			query = query.Must(m)
+		}
+	}
+	for _, value := range fields["kind"] {
+		query = query.Filter(elastic.NewTermQuery("kind", value))
+	}
+	return query.Filter(filters...)
+}
 
-	go func() {
-		log.Println("listening at", envBind)
-		chErr <- e.Start(envBind)
-	}()
+// parseFuzzy parse query param fuzzy, defaults to true
+func parseFuzzy(c echo.Context) bool {
+	if fuzzy, err := strconv.ParseBool(c.QueryParam("fuzzy")); err == nil {
+		return fuzzy
+	}
+	return true
+}
 
-	select {
-	case err = <-chErr:
+// parseRefresh parse query param refresh of write endpoints, one of "true", "false" and "wait_for",
+// empty for elasticsearch default
+func parseRefresh(c echo.Context) (refresh string, err error) {
+	switch refresh = strings.TrimSpace(c.QueryParam("refresh")); refresh {
+	case "", "true", "false", "wait_for":
+	default:
+		err = echo.NewHTTPError(http.StatusBadRequest, "invalid refresh, expecting true, false or wait_for")
+	}
+	return
+}
+
+// parseAllRevisions parse query param all_revisions, defaults to false
+func parseAllRevisions(c echo.Context) bool {
+	allRevisions, _ := strconv.ParseBool(c.QueryParam("all_revisions"))
+	return allRevisions
+}
+
+// didYouMean assemble a corrected query from term suggestions, returns empty string if nothing corrected
+func didYouMean(q string, suggestions []elastic.SearchSuggestion) string {
+	runes := []rune(q)
+	var out []rune
+	var last int
+	var corrected bool
+	for _, s := range suggestions {
+		if len(s.Options) == 0 || s.Offset < last || s.Offset+s.Length > len(runes) {
+			continue
+		}
+		out = append(out, runes[last:s.Offset]...)
+		out = append(out, []rune(s.Options[0].Text)...)
+		last = s.Offset + s.Length
+		corrected = true
+	}
+	if !corrected {
+		return ""
+	}
+	return string(append(out, runes[last:]...))
+}
+
+// searchSorts supported search sort options
+var searchSorts = map[string][]elastic.Sorter{
+	"relevance": {elastic.NewScoreSort()},
+	"newest":    {elastic.NewFieldSort("created_at").Desc().UnmappedType("date")},
+	"oldest":    {elastic.NewFieldSort("created_at").Asc().UnmappedType("date")},
+	"title":     {elastic.NewFieldSort("title.keyword").Asc().UnmappedType("keyword")},
+}
+
+// parseSearchSort parse query param sort, defaults to relevance
+func parseSearchSort(c echo.Context) (key string, sorters []elastic.Sorter, err error) {
+	if key = strings.TrimSpace(c.QueryParam("sort")); key == "" {
+		key = "relevance"
+	}
+	var ok bool
+	if sorters, ok = searchSorts[key]; !ok {
+		err = echo.NewHTTPError(http.StatusBadRequest, "invalid sort, expecting one of relevance, newest, oldest, title")
+	}
+	return
+}
+
+// parseDate parse a date in RFC3339 or YYYY-MM-DD, a bare date as upper bound covers the whole day
+func parseDate(v string, upper bool) (t time.Time, err error) {
+	if t, err = time.Parse(time.RFC3339, v); err == nil {
 		return
-	case sig := <-chSig:
-		log.Println("signal caught:", sig)
-		time.Sleep(time.Second * 1)
-		err = e.Shutdown(context.Background())
+	}
+	if t, err = time.Parse("2006-01-02", v); err != nil {
+		return
+	}
+	if upper {
+		t = t.Add(time.Hour*24 - time.Millisecond)
+	}
+	return
+}
+
+// newDateRangeFilters build created_at range filter from query params from_date and to_date
+func newDateRangeFilters(c echo.Context) (filters []elastic.Query, err error) {
+	fromDate, toDate := strings.TrimSpace(c.QueryParam("from_date")), strings.TrimSpace(c.QueryParam("to_date"))
+	if fromDate == "" && toDate == "" {
+		return
+	}
+	q := elastic.NewRangeQuery("created_at")
+	if fromDate != "" {
+		var t time.Time
+		if t, err = parseDate(fromDate, false); err != nil {
+			err = echo.NewHTTPError(http.StatusBadRequest, "invalid from_date, expecting RFC3339 or YYYY-MM-DD")
+			return
+		}
+		q = q.Gte(t.Format(time.RFC3339Nano))
+	}
+	if toDate != "" {
+		var t time.Time
+		if t, err = parseDate(toDate, true); err != nil {
+			err = echo.NewHTTPError(http.StatusBadRequest, "invalid to_date, expecting RFC3339 or YYYY-MM-DD")
+			return
+		}
+		q = q.Lte(t.Format(time.RFC3339Nano))
+	}
+	filters = append(filters, q)
+	return
+}
+
+// newSearchHighlight build the highlight for search, fragments are html encoded by elasticsearch
+// and matches are wrapped in <mark> tags, so they are safe to render as html, elasticsearch never
+// cuts a fragment inside a highlight tag, title is always highlighted as a whole
+func newSearchHighlight(fragmentSize int) *elastic.Highlight {
+	return elastic.NewHighlight().Fields(
+		elastic.NewHighlighterField("title").NumOfFragments(0),
+		elastic.NewHighlighterField("body").FragmentSize(fragmentSize).NumOfFragments(1),
+	).Encoder("html").PreTags("<mark>").PostTags("</mark>")
+}
+
+// highlighted returns highlight fragments of field in hit, or escaped fallback if there is none
+func highlighted(hit *elastic.SearchHit, field string, fallback string) template.HTML {
+	if fragments := hit.Highlight[field]; len(fragments) > 0 {
+		return template.HTML(strings.Join(fragments, " ... "))
+	}
+	return template.HTML(template.HTMLEscapeString(fallback))
+}
+
+// checkElasticsearchVersion check major of version is in supported range, formatted as "7" or "6-7"
+func checkElasticsearchVersion(version string, supported string) error {
+	major, err := strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+	if err != nil {
+		return fmt.Errorf("invalid elasticsearch version %q", version)
+	}
+	splits := strings.SplitN(supported, "-", 2)
+	var min, max int
+	if min, err = strconv.Atoi(strings.TrimSpace(splits[0])); err != nil {
+		return fmt.Errorf("invalid KB_ES_VERSION_CHECK %q", supported)
+	}
+	max = min
+	if len(splits) == 2 {
+		if max, err = strconv.Atoi(strings.TrimSpace(splits[1])); err != nil {
+			return fmt.Errorf("invalid KB_ES_VERSION_CHECK %q", supported)
+		}
+	}
+	if major < min || major > max {
+		return fmt.Errorf("elasticsearch %s is not supported, expecting major version %s", version, supported)
+	}
+	return nil
+}
+
+// isResultWindowTooLarge whether err is elasticsearch rejecting a too deep from + size
+func isResultWindowTooLarge(err error) bool {
+	var ee *elastic.Error
+	if !errors.As(err, &ee) || ee.Details == nil {
+		return false
+	}
+	for _, cause := range append([]*elastic.ErrorDetails{ee.Details}, ee.Details.RootCause...) {
+		if cause != nil && strings.Contains(cause.Reason, "Result window is too large") {
+			return true
+		}
+	}
+	return false
+}
+
+// APIError error envelope of json api
+type APIError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// errorCode machine readable code of http status, like "not_found"
+func errorCode(status int) string {
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
+
+// describeError map err to http status and message, elasticsearch errors are mapped to matching statuses,
+// details of unknown errors are only exposed if verbose
+func describeError(err error, verbose bool) (status int, message string) {
+	var he *echo.HTTPError
+	switch {
+	case errors.As(err, &he):
+		return he.Code, fmt.Sprintf("%v", he.Message)
+	case errors.Is(err, context.DeadlineExceeded), elastic.IsTimeout(err):
+		return http.StatusGatewayTimeout, "elasticsearch query timed out, please retry or narrow down the query"
+	case isResultWindowTooLarge(err):
+		return http.StatusBadRequest, "result window too large, please narrow down the query"
+	case elastic.IsNotFound(err):
+		return http.StatusNotFound, "not found"
+	case elastic.IsConflict(err):
+		return http.StatusConflict, "conflict with concurrent changes, please retry"
+	case isTransientError(err):
+		return http.StatusServiceUnavailable, "elasticsearch is busy, please retry later"
+	}
+	status, message = http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)
+	if verbose {
+		message = err.Error()
+	}
+	return
+}
+
+// snippet truncate s to at most n runes
+func snippet(s string, n int) string {
+	r := []rune(strings.TrimSpace(s))
+	if len(r) <= n {
+		return string(r)
+	}
+	return string(r[:n]) + "..."
+}
+
+// buildURL build a link to path with query, carrying access_token of current request if any
+func buildURL(c echo.Context, path string, q url.Values) string {
+	if q == nil {
+		q = url.Values{}
+	}
+	if t := c.QueryParam("access_token"); t != "" {
+		q.Set("access_token", t)
+	}
+	if len(q) == 0 {
+		return path
+	}
+	return path + "?" + q.Encode()
+}
+
+// parseHeaders parse comma separated "Key: Value" pairs into headers
+func parseHeaders(s string) (h http.Header, err error) {
+	h = http.Header{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		splits := strings.SplitN(pair, ":", 2)
+		if len(splits) != 2 || strings.TrimSpace(splits[0]) == "" {
+			err = fmt.Errorf("invalid header %q, expecting \"Key: Value\"", pair)
+			return
+		}
+		h.Add(strings.TrimSpace(splits[0]), strings.TrimSpace(splits[1]))
+	}
+	return
+}
+
+// parseTrustedProxies parse comma separated CIDRs or IPs of trusted proxies
+func parseTrustedProxies(s string) (ranges []*net.IPNet, err error) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		var ipNet *net.IPNet
+		if _, ipNet, err = net.ParseCIDR(item); err != nil {
+			err = fmt.Errorf("invalid KB_TRUST_PROXY %q: %w", item, err)
+			return
+		}
+		ranges = append(ranges, ipNet)
+	}
+	return
+}
+
+func exit(err *error) {
+	if *err != nil {
+		logger.Error("exited with error", "error", *err)
+		os.Exit(1)
+	} else {
+		logger.Info("exited")
+	}
+}
+
+func main() {
+	var err error
+	defer exit(&err)
+
+	var (
+		envElasticsearchURL                                         = strings.TrimSpace(os.Getenv("KB_ELASTICSEARCH_URL"))
+		envESVersionCheck                                           = strings.TrimSpace(os.Getenv("KB_ES_VERSION_CHECK"))
+		envElasticsearchUsername                                    = strings.TrimSpace(os.Getenv("KB_ELASTICSEARCH_USERNAME"))
+		envElasticsearchPassword                                    = strings.TrimSpace(os.Getenv("KB_ELASTICSEARCH_PASSWORD"))
+		envAccessToken                                              = strings.TrimSpace(os.Getenv("KB_ACCESS_TOKEN"))
+		envAccessTokens                                             = strings.TrimSpace(os.Getenv("KB_ACCESS_TOKENS"))
+		envBind                                                     = strings.TrimSpace(os.Getenv("KB_BIND"))
+		envDebug, _                                                 = strconv.ParseBool(strings.TrimSpace(os.Getenv("KB_DEBUG")))
+		envHealthTimeout, _                                         = time.ParseDuration(strings.TrimSpace(os.Getenv("KB_HEALTH_TIMEOUT")))
+		envIndexPrefix                                              = strings.TrimSpace(os.Getenv("KB_INDEX_PREFIX"))
+		envShutdownTimeout, _                                       = time.ParseDuration(strings.TrimSpace(os.Getenv("KB_SHUTDOWN_TIMEOUT")))
+		envGzip, envGzipErr                                         = strconv.ParseBool(strings.TrimSpace(os.Getenv("KB_GZIP")))
+		envAccessLog, _                                             = strconv.ParseBool(strings.TrimSpace(os.Getenv("KB_ACCESS_LOG")))
+		envMetricsToken                                             = strings.TrimSpace(os.Getenv("KB_METRICS_TOKEN"))
+		envCORSOrigins                                              = strings.TrimSpace(os.Getenv("KB_CORS_ORIGINS"))
+		envDialRetries, envDialRetriesErr                           = strconv.Atoi(strings.TrimSpace(os.Getenv("KB_DIAL_RETRIES")))
+		envDialRetryInterval, _                                     = time.ParseDuration(strings.TrimSpace(os.Getenv("KB_DIAL_RETRY_INTERVAL")))
+		envTLSCert                                                  = strings.TrimSpace(os.Getenv("KB_TLS_CERT"))
+		envTLSKey                                                   = strings.TrimSpace(os.Getenv("KB_TLS_KEY"))
+		envKindSort                                                 = strings.TrimSpace(os.Getenv("KB_KIND_SORT"))
+		envKindSeparator                                            = os.Getenv("KB_KIND_SEPARATOR")
+		envIndexTemplate, _                                         = strconv.ParseBool(strings.TrimSpace(os.Getenv("KB_INDEX_TEMPLATE")))
+		envIndexMappingsFile                                        = strings.TrimSpace(os.Getenv("KB_INDEX_MAPPINGS_FILE"))
+		envHomeMode                                                 = strings.ToLower(strings.TrimSpace(os.Getenv("KB_HOME_MODE")))
+		envIndexCacheTTL, envIndexCacheTTLErr                       = time.ParseDuration(strings.TrimSpace(os.Getenv("KB_INDEX_CACHE_TTL")))
+		envBulkBatchSize, _                                         = strconv.Atoi(strings.TrimSpace(os.Getenv("KB_BULK_BATCH_SIZE")))
+		envViewsDir                                                 = strings.TrimSpace(os.Getenv("KB_VIEWS_DIR"))
+		envAssetsDir                                                = strings.TrimSpace(os.Getenv("KB_ASSETS_DIR"))
+		envRateLimit, _                                             = strconv.ParseFloat(strings.TrimSpace(os.Getenv("KB_RATE_LIMIT")), 64)
+		envRateLimitBurst, _                                        = strconv.Atoi(strings.TrimSpace(os.Getenv("KB_RATE_LIMIT_BURST")))
+		envTrustProxy                                               = strings.TrimSpace(os.Getenv("KB_TRUST_PROXY"))
+		envHistory, _                                               = strconv.ParseBool(strings.TrimSpace(os.Getenv("KB_HISTORY")))
+		envHistoryIndex                                             = strings.TrimSpace(os.Getenv("KB_HISTORY_INDEX"))
+		envHistoryRetention, _                                      = time.ParseDuration(strings.TrimSpace(os.Getenv("KB_HISTORY_RETENTION")))
+		envSearchFields                                             = strings.TrimSpace(os.Getenv("KB_SEARCH_FIELDS"))
+		envSearchPreference                                         = strings.TrimSpace(os.Getenv("KB_SEARCH_PREFERENCE"))
+		envBanner                                                   = strings.TrimSpace(os.Getenv("KB_BANNER"))
+		envESHeaders                                                = strings.TrimSpace(os.Getenv("KB_ES_HEADERS"))
+		envSimilarSize, envSimilarSizeErr                           = strconv.Atoi(strings.TrimSpace(os.Getenv("KB_SIMILAR_SIZE")))
+		envESMaxIdleConns, _                                        = strconv.Atoi(strings.TrimSpace(os.Getenv("KB_ES_MAX_IDLE_CONNS")))
+		envESHTTPTimeout, envESHTTPTimeoutErr                       = time.ParseDuration(strings.TrimSpace(os.Getenv("KB_ES_HTTP_TIMEOUT")))
+		envKindAggSize, _                                           = strconv.Atoi(strings.TrimSpace(os.Getenv("KB_KIND_AGG_SIZE")))
+		envESRetry429, envESRetry429Err                             = strconv.Atoi(strings.TrimSpace(os.Getenv("KB_ES_RETRY_429")))
+		envActiveRev                                                = strings.TrimSpace(os.Getenv("KB_ACTIVE_REV"))
+		envSnapshotRepo                                             = strings.TrimSpace(os.Getenv("KB_SNAPSHOT_REPO"))
+		envTokenCookie                                              = strings.TrimSpace(os.Getenv("KB_TOKEN_COOKIE"))
+		envTokenCookieSecure, envTokenCookieSecureErr               = strconv.ParseBool(strings.TrimSpace(os.Getenv("KB_TOKEN_COOKIE_SECURE")))
+		envBasicAuthUser                                            = strings.TrimSpace(os.Getenv("KB_BASIC_AUTH_USER"))
+		envBasicAuthPassword                                        = strings.TrimSpace(os.Getenv("KB_BASIC_AUTH_PASSWORD"))
+		envFacetSize, _                                             = strconv.Atoi(strings.TrimSpace(os.Getenv("KB_FACET_SIZE")))
+		envQueryTimeout, _                                          = time.ParseDuration(strings.TrimSpace(os.Getenv("KB_QUERY_TIMEOUT")))
+		envRequestTimeout, _                                        = time.ParseDuration(strings.TrimSpace(os.Getenv("KB_REQUEST_TIMEOUT")))
+		envElasticsearchSniff, _                                    = strconv.ParseBool(strings.TrimSpace(os.Getenv("KB_ELASTICSEARCH_SNIFF")))
+		envElasticsearchHealthcheck, envElasticsearchHealthcheckErr = strconv.ParseBool(strings.TrimSpace(os.Getenv("KB_ELASTICSEARCH_HEALTHCHECK")))
+		envElasticsearchHealthcheckInterval, _                      = time.ParseDuration(strings.TrimSpace(os.Getenv("KB_ELASTICSEARCH_HEALTHCHECK_INTERVAL")))
+		envHomeCacheTTL, envHomeCacheTTLErr                         = time.ParseDuration(strings.TrimSpace(os.Getenv("KB_HOME_CACHE_TTL")))
+		envLogLevel                                                 = strings.TrimSpace(os.Getenv("KB_LOG_LEVEL"))
+		envLogFormat                                                = strings.TrimSpace(os.Getenv("KB_LOG_FORMAT"))
+		envBodyLimit                                                = strings.TrimSpace(os.Getenv("KB_BODY_LIMIT"))
+		envBulkBodyLimit                                            = strings.TrimSpace(os.Getenv("KB_BULK_BODY_LIMIT"))
+		envReadOnly, _                                              = strconv.ParseBool(strings.TrimSpace(os.Getenv("KB_READ_ONLY")))
+		envSnippetLength, _                                         = strconv.Atoi(strings.TrimSpace(os.Getenv("KB_SNIPPET_LENGTH")))
+		envPrettyJSON, _                                            = strconv.ParseBool(strings.TrimSpace(os.Getenv("KB_PRETTY_JSON")))
+	)
+
+	if envSnippetLength <= 0 {
+		envSnippetLength = 200
+	}
+
+	if envBodyLimit == "" {
+		envBodyLimit = "10M"
+	}
+
+	{
+		level := LogLevelInfo
+		if envLogLevel != "" {
+			if level, err = ParseLogLevel(envLogLevel); err != nil {
+				return
+			}
+		}
+		logger = NewLogger(os.Stderr, level, strings.EqualFold(envLogFormat, "json"))
+	}
+
+	if envESHTTPTimeoutErr != nil || envESHTTPTimeout < 0 {
+		envESHTTPTimeout = 30 * time.Second
+	}
+
+	if envHomeCacheTTLErr != nil || envHomeCacheTTL < 0 {
+		envHomeCacheTTL = time.Minute
+	}
+
+	if envElasticsearchHealthcheckErr != nil {
+		envElasticsearchHealthcheck = true
+	}
+
+	if envQueryTimeout <= 0 {
+		envQueryTimeout = time.Second * 15
+	}
+
+	if envFacetSize <= 0 {
+		envFacetSize = 20
+	}
+
+	if envViewsDir == "" {
+		envViewsDir = "views"
+	}
+	if envAssetsDir == "" {
+		envAssetsDir = "assets"
+	}
+	if envHistoryIndex == "" {
+		envHistoryIndex = "kb-history"
+	}
+	if envESRetry429Err == nil && envESRetry429 >= 0 {
+		esRetries = envESRetry429
+	}
+	if envSimilarSizeErr != nil || envSimilarSize < 0 {
+		envSimilarSize = 5
+	}
+	if envSimilarSize > maxSearchSize {
+		envSimilarSize = maxSearchSize
+	}
+	if envKindAggSize <= 0 || envKindAggSize > maxKindAggSize {
+		envKindAggSize = 9999
+	}
+	if envTokenCookie != "" {
+		accessTokenCookie = envTokenCookie
+	}
+	if envTokenCookieSecureErr != nil {
+		envTokenCookieSecure = envTLSCert != ""
+	}
+	if envESMaxIdleConns <= 0 {
+		envESMaxIdleConns = 32
+	}
+	if envSearchFields != "" {
+		if searchFields, err = parseSearchFields(envSearchFields); err != nil {
+			return
+		}
+	}
+	searchPreference = envSearchPreference
+
+	if envBulkBatchSize <= 0 {
+		envBulkBatchSize = 500
+	}
+
+	if envIndexCacheTTLErr != nil || envIndexCacheTTL < 0 {
+		envIndexCacheTTL = time.Second * 30
+	}
+
+	if envKindSort == "" {
+		envKindSort = "title.keyword"
+	}
+	if envKindSeparator == "" {
+		envKindSeparator = "."
+	}
+	switch envHomeMode {
+	case "":
+		envHomeMode = "kinds"
+	case "kinds", "recent", "search":
+	default:
+		err = fmt.Errorf("invalid KB_HOME_MODE %q, expecting kinds, recent or search", envHomeMode)
+		return
+	}
+	// only the kind table is safe for anonymous visitors, other home modes show documents
+	if envHomeMode != "kinds" {
+		delete(publicPaths, "/")
+	}
+
+	if (envTLSCert == "") != (envTLSKey == "") {
+		err = errors.New("both KB_TLS_CERT and KB_TLS_KEY must be set to enable tls")
+		return
+	}
+
+	if envDialRetriesErr != nil || envDialRetries < 0 {
+		envDialRetries = 5
+	}
+	if envDialRetryInterval <= 0 {
+		envDialRetryInterval = time.Second
+	}
+
+	if envGzipErr != nil {
+		envGzip = true
+	}
+
+	if envBind == "" {
+		envBind = ":8080"
+	}
+	if envShutdownTimeout <= 0 {
+		envShutdownTimeout = time.Second * 10
+	}
+	if envIndexPrefix == "" {
+		envIndexPrefix = defaultIndexPrefix
+	}
+
+	indexPattern := envIndexPrefix + "*"
+
+	basicAuth := BasicCredentials{User: envBasicAuthUser, Password: envBasicAuthPassword}
+	accessTokens := ParseAccessTokens(envAccessToken, envAccessTokens, !basicAuth.Enabled())
+
+	if envHealthTimeout <= 0 {
+		envHealthTimeout = time.Second * 2
+	}
+
+	var urls []string
+	for _, u := range strings.Split(envElasticsearchURL, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+
+	// longClient has no overall http timeout, for reindex and snapshot waiting for completion
+	var client, longClient *elastic.Client
+
+	{
+		// keep more idle connections than the default 2 per host to avoid churn under load,
+		// requests are bounded by KB_ES_HTTP_TIMEOUT, queries also by KB_QUERY_TIMEOUT
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxIdleConns = envESMaxIdleConns * 4
+		transport.MaxIdleConnsPerHost = envESMaxIdleConns
+		// sniffing is disabled by default, all given urls are used as is, typically coordinating nodes
+		opts := []elastic.ClientOptionFunc{
+			elastic.SetHttpClient(&http.Client{Transport: transport, Timeout: envESHTTPTimeout}),
+			elastic.SetURL(urls...),
+			elastic.SetSniff(envElasticsearchSniff),
+			elastic.SetHealthcheck(envElasticsearchHealthcheck),
+		}
+		if envElasticsearchHealthcheckInterval > 0 {
+			opts = append(opts, elastic.SetHealthcheckInterval(envElasticsearchHealthcheckInterval))
+		}
+		if envElasticsearchUsername != "" && envElasticsearchPassword != "" {
+			opts = append(opts, elastic.SetBasicAuth(envElasticsearchUsername, envElasticsearchPassword))
+		}
+		if envESHeaders != "" {
+			var headers http.Header
+			if headers, err = parseHeaders(envESHeaders); err != nil {
+				err = fmt.Errorf("invalid KB_ES_HEADERS: %w", err)
+				return
+			}
+			opts = append(opts, elastic.SetHeaders(headers))
+		}
+
+		interval := envDialRetryInterval
+		for attempt := 0; ; attempt++ {
+			logger.Info("dialing elasticsearch", "attempt", attempt+1)
+			if client, err = elastic.Dial(opts...); err == nil {
+				break
+			}
+			if attempt >= envDialRetries {
+				return
+			}
+			logger.Warn("failed to dial elasticsearch", "error", err, "retry_in", interval)
+			time.Sleep(interval)
+			interval *= 2
+		}
+		// same nodes and credentials, health is already checked by client
+		opts = append(opts, elastic.SetHttpClient(&http.Client{Transport: transport}), elastic.SetHealthcheck(false))
+		if longClient, err = elastic.NewClient(opts...); err != nil {
+			return
+		}
+	}
+
+	// the elastic v7 client talks to elasticsearch 7, fail early instead of confusing query errors
+	if envESVersionCheck != "off" {
+		if envESVersionCheck == "" {
+			envESVersionCheck = "7"
+		}
+		versionURLs := urls
+		if len(versionURLs) == 0 {
+			versionURLs = []string{elastic.DefaultURL}
+		}
+		// any node may be down at startup, ask each in turn
+		var version string
+		for _, u := range versionURLs {
+			if version, err = client.ElasticsearchVersion(u); err == nil {
+				break
+			}
+			logger.Warn("failed to detect elasticsearch version", "error", err)
+		}
+		if err != nil {
+			return
+		}
+		logger.Info("elasticsearch version detected", "version", version)
+		if err = checkElasticsearchVersion(version, envESVersionCheck); err != nil {
+			return
+		}
+	}
+
+	// queryContext derive a context for elasticsearch queries from request context
+	queryContext := func(c echo.Context) (context.Context, context.CancelFunc) {
+		return context.WithTimeout(c.Request().Context(), envQueryTimeout)
+	}
+
+	var activeRev int
+	if envActiveRev != "" {
+		if activeRev, err = strconv.Atoi(envActiveRev); err != nil || activeRev < 1 {
+			err = fmt.Errorf("invalid KB_ACTIVE_REV %q", envActiveRev)
+			return
+		}
+		logger.Warn("!!! active index overridden by KB_ACTIVE_REV, alias and highest revision are ignored !!!", "index", envIndexPrefix+envActiveRev)
+	}
+
+	indexCache := NewIndexCache(client, envIndexPrefix, envIndexCacheTTL, activeRev)
+
+	var indexMappings map[string]interface{}
+	if indexMappings, err = loadIndexMappings(envIndexMappingsFile); err != nil {
+		return
+	}
+	if envIndexTemplate && !envReadOnly {
+		if err = putIndexTemplate(context.Background(), client, envIndexPrefix, indexMappings); err != nil {
+			return
+		}
+		logger.Info("index template ensured", "template", indexTemplateName(envIndexPrefix), "pattern", indexPattern)
+	}
+
+	// history is nil unless enabled
+	var history *History
+	if envHistory {
+		history = NewHistory(client, envHistoryIndex, envHistoryRetention)
+		if err = history.Init(context.Background()); err != nil {
+			return
+		}
+	}
+
+	renderer := &Renderer{banner: envBanner}
+
+	homeCache := NewResponseCache(envHomeCacheTTL, maxHomeCacheEntries)
+
+	metrics := NewMetrics()
+
+	go func() {
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), envHealthTimeout)
+			res, err := client.ClusterHealth().Do(ctx)
+			cancel()
+			metrics.SetElasticsearchUp(err == nil && (res.Status == "green" || res.Status == "yellow"))
+			time.Sleep(time.Second * 15)
+		}
+	}()
+
+	_ = client
+
+	e := echo.New()
+	e.Debug = envDebug
+	e.HideBanner = true
+	e.HidePort = true
+	e.Renderer = renderer
+	// client ip is taken from X-Forwarded-For only if the request comes from a trusted proxy,
+	// otherwise the header can be forged to bypass rate limit
+	if envTrustProxy != "" {
+		var ranges []*net.IPNet
+		if ranges, err = parseTrustedProxies(envTrustProxy); err != nil {
+			return
+		}
+		options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+		for _, r := range ranges {
+			options = append(options, echo.TrustIPRange(r))
+		}
+		e.IPExtractor = echo.ExtractIPFromXFFHeader(options...)
+	} else {
+		e.IPExtractor = echo.ExtractIPDirect()
+	}
+	e.HTTPErrorHandler = func(err error, c echo.Context) {
+		if c.Response().Committed {
+			return
+		}
+		requestID := c.Response().Header().Get(echo.HeaderXRequestID)
+		code, message := describeError(err, envDebug)
+		logger.Error("request failed", "request_id", requestID, "error", err)
+		if c.Request().Method == http.MethodHead {
+			err = c.NoContent(code)
+		} else if strings.HasPrefix(c.Request().URL.Path, "/api/") {
+			err = c.JSON(code, map[string]interface{}{"error": APIError{
+				Code:      errorCode(code),
+				Message:   message,
+				RequestID: requestID,
+			}})
+		} else {
+			err = c.Render(code, "error", map[string]interface{}{"Code": code, "Message": message, "RequestID": requestID})
+		}
+		if err != nil {
+			logger.Error("failed to render error", "request_id", requestID, "error", err)
+			// templates may be not loaded at all, fallback to plain text
+			if !c.Response().Committed {
+				_ = c.String(code, message)
+			}
+		}
+	}
+	// unknown routes pass through access token check before reaching here, so their existence is not leaked
+	echo.NotFoundHandler = func(c echo.Context) error {
+		if strings.HasPrefix(c.Request().URL.Path, "/api/") {
+			return echo.ErrNotFound
+		}
+		return c.Render(http.StatusNotFound, "404", map[string]interface{}{
+			"Path":      c.Request().URL.Path,
+			"RequestID": c.Response().Header().Get(echo.HeaderXRequestID),
+		})
+	}
+	e.Use(middleware.Recover())
+	e.Use(middleware.RequestID())
+	// streaming bulk ingestion has its own limit, unlimited unless KB_BULK_BODY_LIMIT is set
+	e.Use(middleware.BodyLimitWithConfig(middleware.BodyLimitConfig{
+		Skipper: func(c echo.Context) bool {
+			return c.Path() == "/api/bulk"
+		},
+		Limit: envBodyLimit,
+	}))
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if envDebug || !renderer.Loaded() {
+				if err := renderer.Reload(envViewsDir); err != nil {
+					return err
+				}
+			}
+			return next(c)
+		}
+	})
+	e.Use(metrics.Middleware)
+	// deadline is set on request context, elasticsearch queries derived from it by queryContext are cancelled too
+	if envRequestTimeout > 0 {
+		e.Use(TimeoutMiddleware(envRequestTimeout, longRunningPaths))
+	}
+	if envDebug || envAccessLog {
+		e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
+			Format: "${time_rfc3339} ${remote_ip} ${method} ${uri} ${status} ${latency_human}\n",
+			Output: &RedactWriter{Writer: os.Stdout},
+		}))
+	}
+	if envGzip {
+		e.Use(middleware.GzipWithConfig(middleware.GzipConfig{
+			Level: 5,
+			Skipper: func(c echo.Context) bool {
+				return probePaths[c.Path()]
+			},
+		}))
+	}
+	if envReadOnly {
+		logger.Info("read-only mode is active, all write and admin endpoints are disabled")
+		e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				switch c.Request().Method {
+				case http.MethodGet, http.MethodHead, http.MethodOptions:
+					if !strings.HasPrefix(c.Request().URL.Path, "/admin/") {
+						return next(c)
+					}
+				case http.MethodPost:
+					if readOnlySafePaths[c.Path()] {
+						return next(c)
+					}
+				}
+				return echo.NewHTTPError(http.StatusForbidden, "read-only mode")
+			}
+		})
+	}
+	// echo indents json if query param pretty is present at all, normalize it so pretty=false works,
+	// and KB_PRETTY_JSON decides when it's absent
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if strings.HasPrefix(c.Request().URL.Path, "/api/") {
+				q := c.QueryParams()
+				pretty := envPrettyJSON
+				if v, ok := q["pretty"]; ok {
+					pretty = true
+					if b, err := strconv.ParseBool(v[0]); err == nil {
+						pretty = b
+					}
+				}
+				if pretty {
+					q.Set("pretty", "true")
+				} else {
+					q.Del("pretty")
+				}
+			}
+			return next(c)
+		}
+	})
+	if envCORSOrigins != "" {
+		var origins []string
+		for _, o := range strings.Split(envCORSOrigins, ",") {
+			if o = strings.TrimSpace(o); o != "" {
+				origins = append(origins, o)
+			}
+		}
+		e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
+			Skipper: func(c echo.Context) bool {
+				return !strings.HasPrefix(c.Request().URL.Path, "/api/")
+			},
+			AllowOrigins: origins,
+			AllowMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete},
+			AllowHeaders: []string{echo.HeaderAuthorization, echo.HeaderContentType},
+		}))
+	}
+	// rate limit is applied before access token check, so token guessing is throttled too
+	if envRateLimit > 0 {
+		if envRateLimitBurst <= 0 {
+			envRateLimitBurst = int(math.Ceil(envRateLimit))
+		}
+		e.Use(NewRateLimiter(envRateLimit, envRateLimitBurst).Middleware(probePaths))
+	}
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if publicPaths[c.Path()] {
+				// landing on home page with access token is the usual entry
+				if _, ok := accessTokens.Match(c); ok {
+					rememberAccessToken(c, envTokenCookieSecure)
+				}
+				return next(c)
+			}
+			label, ok := accessTokens.Match(c)
+			if ok {
+				rememberAccessToken(c, envTokenCookieSecure)
+			} else if basicAuth.Match(c) {
+				label, ok = "basic:"+basicAuth.User, true
+			}
+			if !ok {
+				// let browsers prompt for credentials
+				if basicAuth.Enabled() {
+					c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="Knowledge Base"`)
+					return echo.NewHTTPError(http.StatusUnauthorized, "invalid access_token or credentials")
+				}
+				return echo.NewHTTPError(http.StatusForbidden, "invalid access_token")
+			}
+			if envDebug || envAccessLog {
+				logger.Info("access granted", "label", label, "method", c.Request().Method, "path", c.Path())
+			}
+			return next(c)
+		}
+	})
+	// static assets are public, so styles also load on error pages
+	e.GET("/assets/*", echo.WrapHandler(http.StripPrefix("/assets/", http.FileServer(assetsFileSystem(envAssetsDir)))))
+	e.GET("/metrics", func(c echo.Context) (err error) {
+		if envMetricsToken != "" && !checkAccessToken(c, envMetricsToken) {
+			return c.String(http.StatusForbidden, "invalid access_token")
+		}
+		c.Response().Header().Set(echo.HeaderContentType, "text/plain; version=0.0.4")
+		c.Response().WriteHeader(http.StatusOK)
+		_, err = metrics.WriteTo(c.Response())
+		return
+	})
+	e.GET("/livez", func(c echo.Context) error {
+		return c.String(http.StatusOK, "ok")
+	})
+	readiness := func(c echo.Context) error {
+		ctx, cancel := context.WithTimeout(c.Request().Context(), envHealthTimeout)
+		defer cancel()
+		res, err := client.ClusterHealth().Do(ctx)
+		if err != nil {
+			// probes are public, details of elasticsearch are logged only
+			logger.Warn("elasticsearch health check failed", "error", err)
+			return c.String(http.StatusServiceUnavailable, "unavailable")
+		}
+		if res.Status != "green" && res.Status != "yellow" {
+			return c.String(http.StatusServiceUnavailable, res.Status)
+		}
+		return c.String(http.StatusOK, res.Status)
+	}
+	e.GET("/readyz", readiness)
+	e.GET("/healthz", readiness)
+	e.GET("/", func(c echo.Context) (err error) {
+		ctx, cancel := queryContext(c)
+		defer cancel()
+		// access token is rendered into the page, so it's part of the key, but only a valid one,
+		// home page may be public and random tokens must not fill the cache
+		cacheQuery := url.Values{}
+		for _, key := range homeCacheParams {
+			if v := c.QueryParam(key); v != "" {
+				cacheQuery.Set(key, v)
+			}
+		}
+		cacheKey := cacheQuery.Encode()
+		cacheable := true
+		if cacheQuery.Get("access_token") != "" {
+			_, cacheable = accessTokens.Match(c)
+		}
+		if nocache, _ := strconv.ParseBool(c.QueryParam("nocache")); !nocache && cacheable {
+			if body, ok := homeCache.Get(cacheKey); ok {
+				return c.HTMLBlob(http.StatusOK, body)
+			}
+		}
+		renderCached := func(name string, data interface{}) (err error) {
+			buf := &bytes.Buffer{}
+			if err = renderer.Render(buf, name, data, c); err != nil {
+				return
+			}
+			if cacheable {
+				homeCache.Set(cacheKey, buf.Bytes())
+			}
+			return c.HTMLBlob(http.StatusOK, buf.Bytes())
+		}
+		// small deployments may prefer recent documents or a plain search box over the kind table
+		switch envHomeMode {
+		case "recent":
+			var paging Paging
+			if paging, err = parsePaging(c, "limit", 20, maxSearchSize); err != nil {
+				return
+			}
+			var index string
+			if index, err = indexCache.Active(ctx); err != nil {
+				return
+			}
+			var docs []RecentDoc
+			if docs, err = recentDocs(ctx, client, index, paging.Size); err != nil {
+				return
+			}
+			for i := range docs {
+				docs[i].URL = buildURL(c, "/doc/"+url.PathEscape(docs[i].ID), nil)
+			}
+			return renderCached("recent", map[string]interface{}{"Docs": docs})
+		case "search":
+			return renderCached("search", SearchData{AccessToken: c.QueryParam("access_token")})
+		}
+		type DataKind struct {
+			Kind  string
+			Count int64
+			URL   string
+		}
+		type Data struct {
+			AccessToken string
+			KindPrefix  string
+			Empty       bool
+			Truncated   bool
+			Kinds       []DataKind
+			Indices     []IndexRev
+			HomeURL     string
+			TreeURL     string
+			Page        int
+			PerPage     int
+			TotalPages  int
+			PrevURL     string
+			NextURL     string
+		}
+		var paging Paging
+		if paging, err = parsePaging(c, "per_page", 50, 1000); err != nil {
+			return
+		}
+		data := Data{
+			AccessToken: c.QueryParam("access_token"),
+			KindPrefix:  strings.TrimSpace(c.QueryParam("kind_prefix")),
+			HomeURL:     buildURL(c, "/", nil),
+			TreeURL:     buildURL(c, "/kinds/tree", nil),
+			Page:        paging.Page,
+			PerPage:     paging.Size,
+		}
+		aggSize := envKindAggSize
+		if v := c.QueryParam("kind_agg_size"); v != "" {
+			if aggSize, err = strconv.Atoi(v); err != nil || aggSize < 1 || aggSize > maxKindAggSize {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid kind_agg_size, expecting 1 to %d", maxKindAggSize))
+			}
+		}
+		if data.Indices, err = indexCache.Indices(ctx); err != nil {
+			return
+		}
+		{
+			var query elastic.Query
+			if data.KindPrefix != "" {
+				query = elastic.NewPrefixQuery("kind", data.KindPrefix)
+			}
+			var kinds []KindCount
+			if kinds, data.Truncated, err = aggregateKinds(ctx, client, indexPattern, query, aggSize); err != nil {
+				return
+			}
+			data.Empty = len(kinds) == 0 && data.KindPrefix == ""
+			for _, kind := range kinds {
+				data.Kinds = append(data.Kinds, DataKind{
+					Kind:  kind.Kind,
+					Count: kind.Count,
+					URL:   buildURL(c, "/kind/"+url.PathEscape(kind.Kind), nil),
+				})
+			}
+		}
+		{
+			sort.SliceStable(data.Kinds, func(i, j int) bool {
+				return data.Kinds[i].Count > data.Kinds[j].Count
+			})
+			data.TotalPages = (len(data.Kinds) + data.PerPage - 1) / data.PerPage
+			if data.TotalPages == 0 {
+				data.TotalPages = 1
+			}
+			if data.Page > data.TotalPages {
+				data.Page = data.TotalPages
+			}
+			start := (data.Page - 1) * data.PerPage
+			end := start + data.PerPage
+			if end > len(data.Kinds) {
+				end = len(data.Kinds)
+			}
+			data.Kinds = data.Kinds[start:end]
+
+			pageURL := func(page int) string {
+				q := url.Values{}
+				if data.KindPrefix != "" {
+					q.Set("kind_prefix", data.KindPrefix)
+				}
+				if v := c.QueryParam("kind_agg_size"); v != "" {
+					q.Set("kind_agg_size", v)
+				}
+				q.Set("page", strconv.Itoa(page))
+				q.Set("per_page", strconv.Itoa(data.PerPage))
+				return buildURL(c, "/", q)
+			}
+			if data.Page > 1 {
+				data.PrevURL = pageURL(data.Page - 1)
+			}
+			if data.Page < data.TotalPages {
+				data.NextURL = pageURL(data.Page + 1)
+			}
+		}
+		return renderCached("index", data)
+	})
+	// searchIndex resolve the index to search, all revisions are searched and collapsed by doc_id if requested
+	searchIndex := func(ctx context.Context, allRevisions bool, highlight *elastic.Highlight) (index string, collapse *elastic.CollapseBuilder, err error) {
+		if !allRevisions {
+			index, err = indexCache.Active(ctx)
+			return
+		}
+		var indices []IndexRev
+		if indices, err = indexCache.Indices(ctx); err != nil {
+			return
+		}
+		index, collapse = indexPattern, revisionsCollapse(len(indices), highlight)
+		return
+	}
+	// runSearch run the full-text search for html search page and fragment
+	runSearch := func(c echo.Context) (data SearchData, err error) {
+		ctx, cancel := queryContext(c)
+		defer cancel()
+		data = SearchData{
+			AccessToken: c.QueryParam("access_token"),
+			Query:       strings.TrimSpace(c.QueryParam("q")),
+			FromDate:    strings.TrimSpace(c.QueryParam("from_date")),
+			ToDate:      strings.TrimSpace(c.QueryParam("to_date")),
+			Kind:        strings.TrimSpace(c.QueryParam("kind")),
+			Fuzzy:       parseFuzzy(c),
+			AllRevs:     parseAllRevisions(c),
+		}
+		facetURL := func(kind string) string {
+			q := c.Request().URL.Query()
+			if kind == "" {
+				q.Del("kind")
+			} else {
+				q.Set("kind", kind)
+			}
+			return "/search?" + q.Encode()
+		}
+		var filters []elastic.Query
+		if filters, err = newDateRangeFilters(c); err != nil {
+			return
+		}
+		var sorters []elastic.Sorter
+		if data.Sort, sorters, err = parseSearchSort(c); err != nil {
+			return
+		}
+		var paging Paging
+		if paging, err = parsePaging(c, "size", 10, maxSearchSize); err != nil {
+			return
+		}
+		snippetLength := envSnippetLength
+		if v := c.QueryParam("snippet_length"); v != "" {
+			if snippetLength, err = strconv.Atoi(v); err != nil || snippetLength < 20 || snippetLength > 2000 {
+				err = echo.NewHTTPError(http.StatusBadRequest, "invalid snippet_length, expecting 20 to 2000")
+				return
+			}
+		}
+		if data.Query == "" {
+			return
+		}
+		highlight := newSearchHighlight(snippetLength)
+		var index string
+		var collapse *elastic.CollapseBuilder
+		if index, collapse, err = searchIndex(ctx, data.AllRevs, highlight); err != nil {
+			return
+		}
+		// kind is applied as post filter, so facets still list all kinds matching the query
+		search := client.Search(index).Preference(searchPreference).Query(
+			newSearchQuery(data.Query, data.Fuzzy, filters...),
+		).From(paging.From).Size(paging.Size).SortBy(sorters...).Highlight(highlight).Aggregation(
+			"kinds", elastic.NewTermsAggregation().Field("kind").Size(envFacetSize),
+		).Aggregation(
+			"indices", newIndexCountsAggregation(),
+		).Suggester(
+			elastic.NewTermSuggester("did_you_mean").Text(data.Query).Field("title"),
+		)
+		if collapse != nil {
+			search = search.Collapse(collapse)
+		}
+		if data.Kind != "" {
+			search = search.PostFilter(elastic.NewTermQuery("kind", data.Kind))
+			data.AllKindsURL = facetURL("")
+		}
+		var res *elastic.SearchResult
+		if err = retryTransient(ctx, func() (err error) {
+			res, err = search.Do(ctx)
+			return
+		}); err != nil {
+			return
+		}
+		data.Total = res.TotalHits()
+		data.Indices = indexCounts(res)
+		if data.Total == 0 {
+			if data.Suggestion = didYouMean(data.Query, res.Suggest["did_you_mean"]); data.Suggestion != "" {
+				q := c.Request().URL.Query()
+				q.Set("q", data.Suggestion)
+				data.SuggestURL = "/search?" + q.Encode()
+			}
+		}
+		if items, _ := res.Aggregations.Terms("kinds"); items != nil {
+			for _, bucket := range items.Buckets {
+				kind := fmt.Sprintf("%v", bucket.Key)
+				data.Facets = append(data.Facets, SearchFacet{
+					Kind:   kind,
+					Count:  bucket.DocCount,
+					URL:    facetURL(kind),
+					Active: kind == data.Kind,
+				})
+			}
+		}
+		for _, hit := range res.Hits.Hits {
+			hit = newestRevision(hit, envIndexPrefix)
+			var doc Doc
+			if err = json.Unmarshal(hit.Source, &doc); err != nil {
+				return
+			}
+			data.Hits = append(data.Hits, SearchHit{
+				ID:      hit.Id,
+				Kind:    doc.Kind,
+				Title:   highlighted(hit, "title", doc.Title),
+				Snippet: highlighted(hit, "body", snippet(doc.Body, snippetLength)),
+				URL:     buildURL(c, "/doc/"+url.PathEscape(hit.Id), nil),
+			})
+		}
+		return
+	}
+	e.GET("/search", func(c echo.Context) (err error) {
+		var data SearchData
+		if data, err = runSearch(c); err != nil {
+			return
+		}
+		return c.Render(http.StatusOK, "search", data)
+	})
+	// search form posted from other pages, redirected so results are bookmarkable
+	e.POST("/search", func(c echo.Context) (err error) {
+		var form url.Values
+		if form, err = c.FormParams(); err != nil {
+			return
+		}
+		for k := range form {
+			if form.Get(k) == "" {
+				form.Del(k)
+			}
+		}
+		return c.Redirect(http.StatusSeeOther, "/search?"+form.Encode())
+	})
+	// search results only, without page layout, for incremental search
+	e.GET("/search-fragment", func(c echo.Context) (err error) {
+		var data SearchData
+		if data, err = runSearch(c); err != nil {
+			return
+		}
+		return c.Render(http.StatusOK, "search_results", data)
+	})
+	// browseKind list documents of kind, optionally matching q, paged by from or by search_after cursor,
+	// _id is the tiebreaker so the cursor is stable, next cursor is empty if there are no more documents
+	browseKind := func(c echo.Context, kind string, q string, paging Paging) (res *elastic.SearchResult, next string, err error) {
+		ctx, cancel := queryContext(c)
+		defer cancel()
+		var after []interface{}
+		if v := c.QueryParam("cursor"); v != "" {
+			if after, err = decodeCursor(v); err != nil {
+				return
+			}
+		}
+		var index string
+		if index, err = indexCache.Active(ctx); err != nil {
+			return
+		}
+		// plain browsing sorts by KB_KIND_SORT, searching within kind sorts by relevance
+		search := client.Search(index).Preference(searchPreference).Size(paging.Size)
+		if q == "" {
+			search = search.Query(elastic.NewTermQuery("kind", kind)).SortBy(
+				elastic.NewFieldSort(envKindSort).Asc().UnmappedType("keyword"),
+				elastic.NewFieldSort("_id").Asc(),
+			)
+		} else {
+			search = search.Query(newSearchQuery(q, parseFuzzy(c), elastic.NewTermQuery("kind", kind))).SortBy(
+				elastic.NewScoreSort().Desc(),
+				elastic.NewFieldSort("_id").Asc(),
+			)
+		}
+		if after != nil {
+			search = search.SearchAfter(after...)
+		} else {
+			search = search.From(paging.From)
+		}
+		if err = retryTransient(ctx, func() (err error) {
+			res, err = search.Do(ctx)
+			return
+		}); err != nil {
+			return
+		}
+		if hits := res.Hits.Hits; len(hits) == paging.Size {
+			if next, err = encodeCursor(hits[len(hits)-1].Sort); err != nil {
+				return
+			}
+		}
+		return
+	}
+	// kinds as a tree by KB_KIND_SEPARATOR, for navigating namespaced kinds like team.project.doc
+	e.GET("/kinds/tree", func(c echo.Context) (err error) {
+		ctx, cancel := queryContext(c)
+		defer cancel()
+		type Data struct {
+			HomeURL   string
+			Separator string
+			Truncated bool
+			Nodes     []*KindNode
+		}
+		data := Data{HomeURL: buildURL(c, "/", nil), Separator: envKindSeparator}
+		var kinds []KindCount
+		if kinds, data.Truncated, err = aggregateKinds(ctx, client, indexPattern, nil, envKindAggSize); err != nil {
+			return
+		}
+		data.Nodes = buildKindTree(kinds, envKindSeparator, func(kind string) string {
+			return buildURL(c, "/kind/"+url.PathEscape(kind), nil)
+		})
+		return c.Render(http.StatusOK, "kinds_tree", data)
+	})
+	e.GET("/kind/:kind", func(c echo.Context) (err error) {
+		type DataDoc struct {
+			ID    string
+			Title string
+			URL   string
+		}
+		type Data struct {
+			AccessToken string
+			Kind        string
+			KindURL     string
+			Query       string
+			HomeURL     string
+			Total       int64
+			Docs        []DataDoc
+			Page        int
+			TotalPages  int
+			PrevURL     string
+			NextURL     string
+		}
+		kind := c.Param("kind")
+		if v, err := url.PathUnescape(kind); err == nil {
+			kind = v
+		}
+		var paging Paging
+		if paging, err = parsePaging(c, "size", 20, maxSearchSize); err != nil {
+			return
+		}
+		data := Data{
+			AccessToken: c.QueryParam("access_token"),
+			Kind:        kind,
+			KindURL:     buildURL(c, "/kind/"+url.PathEscape(kind), nil),
+			Query:       strings.TrimSpace(c.QueryParam("q")),
+			HomeURL:     buildURL(c, "/", nil),
+		}
+		perPage := paging.Size
+		var res *elastic.SearchResult
+		var cursor string
+		if res, cursor, err = browseKind(c, data.Kind, data.Query, paging); err != nil {
+			return
+		}
+		data.Total = res.TotalHits()
+		data.TotalPages = int((data.Total + int64(perPage) - 1) / int64(perPage))
+		for _, hit := range res.Hits.Hits {
+			var doc Doc
+			if err = json.Unmarshal(hit.Source, &doc); err != nil {
+				return
+			}
+			data.Docs = append(data.Docs, DataDoc{
+				ID:    hit.Id,
+				Title: doc.Title,
+				URL:   buildURL(c, "/doc/"+url.PathEscape(hit.Id), nil),
+			})
+		}
+		kindURL := func(q url.Values) string {
+			if c.QueryParam("size") != "" {
+				q.Set("size", strconv.Itoa(perPage))
+			}
+			if data.Query != "" {
+				q.Set("q", data.Query)
+			}
+			return buildURL(c, "/kind/"+url.PathEscape(data.Kind), q)
+		}
+		// next page always follows the cursor, page numbers are only known before following it
+		hasMore := cursor != ""
+		if c.QueryParam("cursor") == "" {
+			data.Page = paging.Page
+			if data.Page > 1 {
+				data.PrevURL = kindURL(url.Values{"page": []string{strconv.Itoa(data.Page - 1)}})
+			}
+			hasMore = hasMore && data.Page < data.TotalPages
+		}
+		if hasMore {
+			data.NextURL = kindURL(url.Values{"cursor": []string{cursor}})
+		}
+		return c.Render(http.StatusOK, "kind", data)
+	})
+	e.GET("/api/kind/:kind", func(c echo.Context) (err error) {
+		type Hit struct {
+			ID    string `json:"id"`
+			Title string `json:"title"`
+		}
+		type Result struct {
+			Total  int64  `json:"total"`
+			Docs   []Hit  `json:"docs"`
+			Cursor string `json:"cursor,omitempty"`
+		}
+		kind := c.Param("kind")
+		if v, err := url.PathUnescape(kind); err == nil {
+			kind = v
+		}
+		var paging Paging
+		if paging, err = parsePaging(c, "size", 20, maxSearchSize); err != nil {
+			return
+		}
+		var res *elastic.SearchResult
+		result := Result{Docs: []Hit{}}
+		if res, result.Cursor, err = browseKind(c, kind, strings.TrimSpace(c.QueryParam("q")), paging); err != nil {
+			return
+		}
+		result.Total = res.TotalHits()
+		for _, hit := range res.Hits.Hits {
+			var doc Doc
+			if err = json.Unmarshal(hit.Source, &doc); err != nil {
+				return
+			}
+			result.Docs = append(result.Docs, Hit{ID: hit.Id, Title: doc.Title})
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+	e.GET("/recent", func(c echo.Context) (err error) {
+		ctx, cancel := queryContext(c)
+		defer cancel()
+		var paging Paging
+		if paging, err = parsePaging(c, "limit", 20, maxSearchSize); err != nil {
+			return
+		}
+		var index string
+		if index, err = indexCache.Active(ctx); err != nil {
+			return
+		}
+		var docs []RecentDoc
+		if docs, err = recentDocs(ctx, client, index, paging.Size); err != nil {
+			return
+		}
+		for i := range docs {
+			docs[i].URL = buildURL(c, "/doc/"+url.PathEscape(docs[i].ID), nil)
+		}
+		return c.Render(http.StatusOK, "recent", map[string]interface{}{"Docs": docs})
+	})
+	// docTemplate kind specific layout, defined as doc_<kind> in views
+	docTemplate := func(kind string) string {
+		if kind != "" && renderer.Has("doc_"+kind) {
+			return "doc_" + kind
+		}
+		return "doc"
+	}
+	e.GET("/doc/:id", func(c echo.Context) (err error) {
+		ctx, cancel := queryContext(c)
+		defer cancel()
+		var index string
+		if index, err = indexCache.Active(ctx); err != nil {
+			return
+		}
+		var res *elastic.GetResult
+		if err = retryTransient(ctx, func() (err error) {
+			res, err = client.Get().Index(index).Id(c.Param("id")).Do(ctx)
+			return
+		}); err != nil {
+			if elastic.IsNotFound(err) {
+				return c.String(http.StatusNotFound, "document not found")
+			}
+			return
+		}
+		var source map[string]interface{}
+		if err = json.Unmarshal(res.Source, &source); err != nil {
+			return
+		}
+		data := newDocPage(res.Id, res.Index, source)
+		if history != nil {
+			data.HistoryURL = buildURL(c, "/doc/"+url.PathEscape(res.Id)+"/history", nil)
+		}
+		if envSimilarSize > 0 {
+			// similar documents are optional, the page is rendered without them if the query fails
+			if data.Similar, err = similarDocs(ctx, client, index, res.Id, envSimilarSize); err != nil {
+				logger.Warn("failed to find similar documents", "id", res.Id, "error", err)
+				data.Similar, err = nil, nil
+			}
+			for i, doc := range data.Similar {
+				data.Similar[i].URL = buildURL(c, "/doc/"+url.PathEscape(doc.ID), nil)
+			}
+		}
+		// etag is derived from the rendered page, so changes of similar documents, banner and templates count too
+		buf := &bytes.Buffer{}
+		if err = renderer.Render(buf, docTemplate(data.Kind), data, c); err != nil {
+			return
+		}
+		etag := fmt.Sprintf(`"%x"`, sha256.Sum256(buf.Bytes()))
+		c.Response().Header().Set("ETag", etag)
+		if match := c.Request().Header.Get("If-None-Match"); match != "" {
+			for _, m := range strings.Split(match, ",") {
+				if m = strings.TrimSpace(m); m == etag || m == "*" {
+					return c.NoContent(http.StatusNotModified)
+				}
+			}
+		}
+		return c.HTMLBlob(http.StatusOK, buf.Bytes())
+	})
+	// render a document through document page without indexing, validation errors are shown inline
+	e.POST("/preview", func(c echo.Context) (err error) {
+		var doc Doc
+		if err = c.Bind(&doc); err != nil {
+			return
+		}
+		code := http.StatusOK
+		verr := doc.Validate()
+		if verr != nil {
+			code = http.StatusBadRequest
+		}
+		var buf []byte
+		if buf, err = json.Marshal(doc); err != nil {
+			return
+		}
+		var source map[string]interface{}
+		if err = json.Unmarshal(buf, &source); err != nil {
+			return
+		}
+		data := newDocPage("(preview)", "", source)
+		data.Preview = true
+		if verr != nil {
+			data.Error = verr.Error()
+		}
+		return c.Render(code, docTemplate(data.Kind), data)
+	})
+	e.GET("/doc/:id/history", func(c echo.Context) (err error) {
+		ctx, cancel := queryContext(c)
+		defer cancel()
+		if history == nil {
+			return echo.NewHTTPError(http.StatusNotFound, "history is not enabled")
+		}
+		type DataField struct {
+			Name  string
+			Value string
+		}
+		type DataEntry struct {
+			Index      string
+			Version    int64
+			ArchivedAt string
+			Fields     []DataField
+		}
+		type Data struct {
+			ID      string
+			DocURL  string
+			Entries []DataEntry
+		}
+		var paging Paging
+		if paging, err = parsePaging(c, "size", 20, maxSearchSize); err != nil {
+			return
+		}
+		id := c.Param("id")
+		var entries []HistoryEntry
+		if entries, err = history.List(ctx, id, paging.Size); err != nil {
+			return
+		}
+		data := Data{ID: id, DocURL: buildURL(c, "/doc/"+url.PathEscape(id), nil)}
+		for _, entry := range entries {
+			var source map[string]interface{}
+			if err = json.Unmarshal(entry.Source, &source); err != nil {
+				return
+			}
+			de := DataEntry{
+				Index:      entry.Index,
+				Version:    entry.Version,
+				ArchivedAt: entry.ArchivedAt.Format(time.RFC3339),
+			}
+			for k, v := range source {
+				de.Fields = append(de.Fields, DataField{Name: k, Value: fmt.Sprintf("%v", v)})
+			}
+			sort.Slice(de.Fields, func(i, j int) bool {
+				return de.Fields[i].Name < de.Fields[j].Name
+			})
+			data.Entries = append(data.Entries, de)
+		}
+		return c.Render(http.StatusOK, "history", data)
+	})
+	e.GET("/api/search", func(c echo.Context) (err error) {
+		ctx, cancel := queryContext(c)
+		defer cancel()
+		type Hit struct {
+			ID     string          `json:"id"`
+			Kind   string          `json:"kind"`
+			Title  string          `json:"title"`
+			Source json.RawMessage `json:"source"`
+		}
+		type Result struct {
+			Total   int64        `json:"total"`
+			Hits    []Hit        `json:"hits"`
+			Indices []IndexCount `json:"indices"`
+		}
+		result := Result{Hits: []Hit{}, Indices: []IndexCount{}}
+		var paging Paging
+		if paging, err = parsePaging(c, "size", 10, maxSearchSize); err != nil {
+			return
+		}
+		size, from := paging.Size, paging.From
+		var filters []elastic.Query
+		if filters, err = newDateRangeFilters(c); err != nil {
+			return
+		}
+		var sorters []elastic.Sorter
+		if _, sorters, err = parseSearchSort(c); err != nil {
+			return
+		}
+		q := strings.TrimSpace(c.QueryParam("q"))
+		if q == "" {
+			return c.JSON(http.StatusOK, result)
+		}
+		var index string
+		var collapse *elastic.CollapseBuilder
+		if index, collapse, err = searchIndex(ctx, parseAllRevisions(c), nil); err != nil {
+			return
+		}
+		search := client.Search(index).Preference(searchPreference).Query(
+			newSearchQuery(q, parseFuzzy(c), filters...),
+		).SortBy(sorters...).From(from).Size(size).Aggregation("indices", newIndexCountsAggregation())
+		if collapse != nil {
+			search = search.Collapse(collapse)
+		}
+		var res *elastic.SearchResult
+		if err = retryTransient(ctx, func() (err error) {
+			res, err = search.Do(ctx)
+			return
+		}); err != nil {
+			return
+		}
+		result.Total = res.TotalHits()
+		result.Indices = indexCounts(res)
+		for _, hit := range res.Hits.Hits {
+			hit = newestRevision(hit, envIndexPrefix)
+			var doc Doc
+			if err = json.Unmarshal(hit.Source, &doc); err != nil {
+				return
+			}
+			result.Hits = append(result.Hits, Hit{
+				ID:     hit.Id,
+				Kind:   doc.Kind,
+				Title:  doc.Title,
+				Source: hit.Source,
+			})
+		}
+		h := c.Response().Header()
+		h.Set("X-Total-Count", strconv.FormatInt(result.Total, 10))
+		h.Set("X-Page", strconv.Itoa(from/size+1))
+		pageLink := func(from int, rel string) string {
+			q := c.Request().URL.Query()
+			q.Set("from", strconv.Itoa(from))
+			q.Set("size", strconv.Itoa(size))
+			return fmt.Sprintf(`<%s?%s>; rel="%s"`, c.Request().URL.Path, q.Encode(), rel)
+		}
+		var links []string
+		if int64(from+size) < result.Total {
+			links = append(links, pageLink(from+size, "next"))
+		}
+		if from > 0 {
+			prev := from - size
+			if prev < 0 {
+				prev = 0
+			}
+			links = append(links, pageLink(prev, "prev"))
+		}
+		if len(links) > 0 {
+			h.Set("Link", strings.Join(links, ", "))
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+	// count documents matching the same query as search, empty q counts all documents
+	e.GET("/api/count", func(c echo.Context) (err error) {
+		ctx, cancel := queryContext(c)
+		defer cancel()
+		var filters []elastic.Query
+		if filters, err = newDateRangeFilters(c); err != nil {
+			return
+		}
+		if kind := strings.TrimSpace(c.QueryParam("kind")); kind != "" {
+			filters = append(filters, elastic.NewTermQuery("kind", kind))
+		}
+		var index string
+		if index, err = indexCache.Active(ctx); err != nil {
+			return
+		}
+		var count int64
+		if count, err = client.Count(index).Query(
+			newSearchQuery(strings.TrimSpace(c.QueryParam("q")), parseFuzzy(c), filters...),
+		).Do(ctx); err != nil {
+			return
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"count": count})
+	})
+	// score breakdown of a document for a query, for tuning relevance, only available in debug mode
+	if envDebug {
+		e.GET("/api/explain", func(c echo.Context) (err error) {
+			ctx, cancel := queryContext(c)
+			defer cancel()
+			id := strings.TrimSpace(c.QueryParam("id"))
+			q := strings.TrimSpace(c.QueryParam("q"))
+			if id == "" || q == "" {
+				return echo.NewHTTPError(http.StatusBadRequest, "missing id or q")
+			}
+			var index string
+			if index, err = indexCache.Active(ctx); err != nil {
+				return
+			}
+			var res *elastic.ExplainResponse
+			if res, err = client.Explain(index, "_doc", id).Query(
+				newSearchQuery(q, parseFuzzy(c)),
+			).Do(ctx); err != nil {
+				if elastic.IsNotFound(err) {
+					return echo.NewHTTPError(http.StatusNotFound, "document not found")
+				}
+				return
+			}
+			return c.JSON(http.StatusOK, res)
+		})
+	}
+	e.GET("/api/recent", func(c echo.Context) (err error) {
+		ctx, cancel := queryContext(c)
+		defer cancel()
+		var paging Paging
+		if paging, err = parsePaging(c, "limit", 20, maxSearchSize); err != nil {
+			return
+		}
+		var index string
+		if index, err = indexCache.Active(ctx); err != nil {
+			return
+		}
+		var docs []RecentDoc
+		if docs, err = recentDocs(ctx, client, index, paging.Size); err != nil {
+			return
+		}
+		return c.JSON(http.StatusOK, docs)
+	})
+	// all kinds with counts, counterpart of kind table of home page
+	e.GET("/api/kinds", func(c echo.Context) (err error) {
+		ctx, cancel := queryContext(c)
+		defer cancel()
+		var minCount int64
+		if v := strings.TrimSpace(c.QueryParam("min_count")); v != "" {
+			if minCount, err = strconv.ParseInt(v, 10, 64); err != nil || minCount < 0 {
+				return echo.NewHTTPError(http.StatusBadRequest, "invalid min_count, expecting a non-negative integer")
+			}
+		}
+		sortBy := strings.TrimSpace(c.QueryParam("sort"))
+		switch sortBy {
+		case "":
+			sortBy = "count"
+		case "name", "count":
+		default:
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid sort, expecting name or count")
+		}
+		type Result struct {
+			Kinds     []KindCount `json:"kinds"`
+			Truncated bool        `json:"truncated"`
+		}
+		var result Result
+		var kinds []KindCount
+		if kinds, result.Truncated, err = aggregateKinds(ctx, client, indexPattern, nil, envKindAggSize); err != nil {
+			return
+		}
+		result.Kinds = []KindCount{}
+		for _, kind := range kinds {
+			if kind.Count >= minCount {
+				result.Kinds = append(result.Kinds, kind)
+			}
+		}
+		// terms aggregation is already ordered by count
+		if sortBy == "name" {
+			sort.Slice(result.Kinds, func(i, j int) bool {
+				return result.Kinds[i].Kind < result.Kinds[j].Kind
+			})
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+	e.GET("/api/kinds/tree", func(c echo.Context) (err error) {
+		ctx, cancel := queryContext(c)
+		defer cancel()
+		type Result struct {
+			Separator string      `json:"separator"`
+			Truncated bool        `json:"truncated"`
+			Nodes     []*KindNode `json:"nodes"`
+		}
+		result := Result{Separator: envKindSeparator}
+		var kinds []KindCount
+		if kinds, result.Truncated, err = aggregateKinds(ctx, client, indexPattern, nil, envKindAggSize); err != nil {
+			return
+		}
+		if result.Nodes = buildKindTree(kinds, envKindSeparator, nil); result.Nodes == nil {
+			result.Nodes = []*KindNode{}
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+	e.GET("/api/kinds/suggest", func(c echo.Context) (err error) {
+		ctx, cancel := queryContext(c)
+		defer cancel()
+		var query elastic.Query
+		if prefix := strings.TrimSpace(c.QueryParam("prefix")); prefix != "" {
+			query = elastic.NewPrefixQuery("kind", prefix)
+		}
+		var kinds []KindCount
+		if kinds, _, err = aggregateKinds(ctx, client, indexPattern, query, 20); err != nil {
+			return
+		}
+		names := []string{}
+		for _, kind := range kinds {
+			names = append(names, kind.Kind)
+		}
+		return c.JSON(http.StatusOK, names)
+	})
+	e.GET("/api/stats", func(c echo.Context) (err error) {
+		ctx, cancel := queryContext(c)
+		defer cancel()
+		type Revision struct {
+			Index     string `json:"index"`
+			Rev       int    `json:"rev"`
+			DocsCount int    `json:"docs_count"`
+		}
+		type Result struct {
+			Total          int64       `json:"total"`
+			KindsCount     int         `json:"kinds_count"`
+			ActiveIndex    string      `json:"active_index"`
+			ActiveRevision int         `json:"active_revision"`
+			Kinds          []KindCount `json:"kinds"`
+			Revisions      []Revision  `json:"revisions"`
+		}
+		var result Result
+		var active IndexRev
+		if active, err = indexCache.ActiveRev(ctx); err != nil {
+			return
+		}
+		result.ActiveIndex, result.ActiveRevision = active.Index, active.Rev
+		// every revision holds a full copy, counts are of the active index only
+		var index string
+		if index, err = indexCache.Active(ctx); err != nil {
+			return
+		}
+		if result.Total, err = client.Count(index).IgnoreUnavailable(true).Do(ctx); err != nil {
+			return
+		}
+		if result.Kinds, _, err = aggregateKinds(ctx, client, index, nil, envKindAggSize); err != nil {
+			return
+		}
+		var indices []IndexRev
+		if indices, err = indexCache.Indices(ctx); err != nil {
+			return
+		}
+		for _, rev := range indices {
+			result.Revisions = append(result.Revisions, Revision{Index: rev.Index, Rev: rev.Rev, DocsCount: rev.DocsCount})
+		}
+		if result.Kinds == nil {
+			result.Kinds = []KindCount{}
+		}
+		result.KindsCount = len(result.Kinds)
+		return c.JSON(http.StatusOK, result)
+	})
+	// documents are exported as ndjson of _source, which can be imported again with /api/bulk
+	e.GET("/api/export", func(c echo.Context) (err error) {
+		// only the active index, other revisions hold copies of the same documents
+		var index string
+		ctx, cancel := queryContext(c)
+		index, err = indexCache.Active(ctx)
+		cancel()
+		if err != nil {
+			return
+		}
+		scroll := client.Scroll(index).Size(1000)
+		if kind := strings.TrimSpace(c.QueryParam("kind")); kind != "" {
+			scroll = scroll.Query(elastic.NewTermQuery("kind", kind))
+		}
+		defer scroll.Clear(context.Background())
+
+		c.Response().Header().Set(echo.HeaderContentType, "application/x-ndjson")
+		c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="kbase-export.ndjson"`)
+		c.Response().WriteHeader(http.StatusOK)
+		for {
+			var res *elastic.SearchResult
+			if res, err = scroll.Do(c.Request().Context()); err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				return
+			}
+			for _, hit := range res.Hits.Hits {
+				if _, err = c.Response().Write(append(hit.Source, '\n')); err != nil {
+					return
+				}
+			}
+			c.Response().Flush()
+		}
+	})
+	e.POST("/api/doc", func(c echo.Context) (err error) {
+		ctx, cancel := queryContext(c)
+		defer cancel()
+		var refresh string
+		if refresh, err = parseRefresh(c); err != nil {
+			return
+		}
+		var doc Doc
+		if err = c.Bind(&doc); err != nil {
+			return
+		}
+		if err = doc.Validate(); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		var index string
+		if index, err = indexCache.Active(ctx); err != nil {
+			return
+		}
+		var id string
+		if id, err = newDocID(); err != nil {
+			return
+		}
+		if doc.DocID == "" {
+			doc.DocID = id
+		}
+		var res *elastic.IndexResponse
+		if res, err = client.Index().Index(index).Id(id).OpType("create").BodyJson(doc).Refresh(refresh).Do(ctx); err != nil {
+			return
+		}
+		return c.JSON(http.StatusCreated, map[string]interface{}{"id": res.Id})
+	})
+	e.GET("/api/doc/:id", func(c echo.Context) (err error) {
+		ctx, cancel := queryContext(c)
+		defer cancel()
+		var index string
+		if index, err = indexCache.Active(ctx); err != nil {
+			return
+		}
+		var res *elastic.GetResult
+		if err = retryTransient(ctx, func() (err error) {
+			res, err = client.Get().Index(index).Id(c.Param("id")).Do(ctx)
+			return
+		}); err != nil {
+			if elastic.IsNotFound(err) {
+				return echo.NewHTTPError(http.StatusNotFound, "document not found")
+			}
+			return
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"_id":      res.Id,
+			"_index":   res.Index,
+			"_version": res.Version,
+			"_source":  res.Source,
+		})
+	})
+	e.GET("/api/doc/:id/similar", func(c echo.Context) (err error) {
+		ctx, cancel := queryContext(c)
+		defer cancel()
+		var paging Paging
+		if paging, err = parsePaging(c, "limit", envSimilarSize, maxSearchSize); err != nil {
+			return
+		}
+		var index string
+		if index, err = indexCache.Active(ctx); err != nil {
+			return
+		}
+		var docs []SimilarDoc
+		if docs, err = similarDocs(ctx, client, index, c.Param("id"), paging.Size); err != nil {
+			if elastic.IsNotFound(err) {
+				return echo.NewHTTPError(http.StatusNotFound, "document not found")
+			}
+			return
+		}
+		return c.JSON(http.StatusOK, docs)
+	})
+	e.PUT("/api/doc/:id", func(c echo.Context) (err error) {
+		ctx, cancel := queryContext(c)
+		defer cancel()
+		var refresh string
+		if refresh, err = parseRefresh(c); err != nil {
+			return
+		}
+		var doc Doc
+		if err = c.Bind(&doc); err != nil {
+			return
+		}
+		if err = doc.Validate(); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		var index string
+		if index, err = indexCache.Active(ctx); err != nil {
+			return
+		}
+		if history != nil {
+			if err = history.Archive(ctx, index, c.Param("id")); err != nil {
+				return
+			}
+		}
+		if doc.DocID == "" {
+			doc.DocID = c.Param("id")
+		}
+		var res *elastic.IndexResponse
+		if res, err = client.Index().Index(index).Id(c.Param("id")).BodyJson(doc).Refresh(refresh).Do(ctx); err != nil {
+			return
+		}
+		code := http.StatusOK
+		if res.Result == "created" {
+			code = http.StatusCreated
+		}
+		return c.JSON(code, map[string]interface{}{"id": res.Id, "result": res.Result})
+	})
+	e.PATCH("/api/doc/:id", func(c echo.Context) (err error) {
+		ctx, cancel := queryContext(c)
+		defer cancel()
+		var refresh string
+		if refresh, err = parseRefresh(c); err != nil {
+			return
+		}
+		var partial map[string]interface{}
+		if err = c.Bind(&partial); err != nil {
+			return
+		}
+		if len(partial) == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "no fields to update")
+		}
+		for _, field := range []string{"kind", "title"} {
+			if v, ok := partial[field]; ok {
+				if str, ok := v.(string); !ok || strings.TrimSpace(str) == "" {
+					return echo.NewHTTPError(http.StatusBadRequest, field+" can not be blank")
+				}
+			}
+		}
+		// documents written before doc_id was set on every write get it on their next update
+		if _, ok := partial["doc_id"]; !ok {
+			partial["doc_id"] = c.Param("id")
+		}
+		var index string
+		if index, err = indexCache.Active(ctx); err != nil {
+			return
+		}
+		if history != nil {
+			if err = history.Archive(ctx, index, c.Param("id")); err != nil {
+				return
+			}
+		}
+		var res *elastic.UpdateResponse
+		if res, err = client.Update().Index(index).Id(c.Param("id")).Doc(partial).Refresh(refresh).Do(ctx); err != nil {
+			if elastic.IsNotFound(err) {
+				return echo.NewHTTPError(http.StatusNotFound, "document not found")
+			}
+			return
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"id": res.Id, "result": res.Result})
+	})
+	var bulkMiddlewares []echo.MiddlewareFunc
+	if envBulkBodyLimit != "" {
+		bulkMiddlewares = append(bulkMiddlewares, middleware.BodyLimit(envBulkBodyLimit))
+	}
+	e.POST("/api/bulk", func(c echo.Context) (err error) {
+		type Result struct {
+			Indexed int      `json:"indexed"`
+			Failed  int      `json:"failed"`
+			Errors  []string `json:"errors,omitempty"`
+		}
+		var result Result
+		fail := func(message string) {
+			result.Failed++
+			if len(result.Errors) < maxBulkErrors {
+				result.Errors = append(result.Errors, message)
+			}
+		}
+		var refresh string
+		if refresh, err = parseRefresh(c); err != nil {
+			return
+		}
+		var index string
+		ctx, cancel := queryContext(c)
+		index, err = indexCache.Active(ctx)
+		cancel()
+		if err != nil {
+			return
+		}
+		bulk := client.Bulk().Index(index).Refresh(refresh)
+		flush := func() (err error) {
+			if bulk.NumberOfActions() == 0 {
+				return
+			}
+			ctx, cancel := queryContext(c)
+			defer cancel()
+			var res *elastic.BulkResponse
+			if res, err = bulk.Do(ctx); err != nil {
+				return
+			}
+			result.Indexed += len(res.Succeeded())
+			for _, item := range res.Failed() {
+				reason := "unknown error"
+				if item.Error != nil {
+					reason = item.Error.Reason
+				}
+				fail(reason)
+			}
+			bulk = client.Bulk().Index(index).Refresh(refresh)
+			return
+		}
+		scanner := bufio.NewScanner(c.Request().Body)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			raw := bytes.TrimSpace(scanner.Bytes())
+			if len(raw) == 0 {
+				continue
+			}
+			var doc Doc
+			if err = json.Unmarshal(raw, &doc); err == nil {
+				err = doc.Validate()
+			}
+			if err != nil {
+				fail(fmt.Sprintf("line %d: %s", line, err.Error()))
+				continue
+			}
+			var id string
+			if id, err = newDocID(); err != nil {
+				return
+			}
+			if doc.DocID == "" {
+				doc.DocID = id
+			}
+			bulk.Add(elastic.NewBulkIndexRequest().OpType("create").Id(id).Doc(doc))
+			if bulk.NumberOfActions() >= envBulkBatchSize {
+				if err = flush(); err != nil {
+					return
+				}
+			}
+		}
+		if err = scanner.Err(); err != nil {
+			return
+		}
+		if err = flush(); err != nil {
+			return
+		}
+		return c.JSON(http.StatusOK, result)
+	}, bulkMiddlewares...)
+	// only the active index is touched, copies in older revisions are kept as is
+	e.DELETE("/api/doc/:id", func(c echo.Context) (err error) {
+		ctx, cancel := queryContext(c)
+		defer cancel()
+		var refresh string
+		if refresh, err = parseRefresh(c); err != nil {
+			return
+		}
+		var index string
+		if index, err = indexCache.Active(ctx); err != nil {
+			return
+		}
+		if history != nil {
+			if err = history.Archive(ctx, index, c.Param("id")); err != nil {
+				return
+			}
+		}
+		if _, err = client.Delete().Index(index).Id(c.Param("id")).Refresh(refresh).Do(ctx); err != nil {
+			if elastic.IsNotFound(err) {
+				return echo.NewHTTPError(http.StatusNotFound, "document not found")
+			}
+			return
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+	// snapshotBefore snapshot index before a destructive operation if requested by query param snapshot=true,
+	// returns empty name if not requested, snapshot is not bounded by KB_QUERY_TIMEOUT as it may take a while
+	snapshotBefore := func(c echo.Context, index string) (name string, err error) {
+		if requested, _ := strconv.ParseBool(c.QueryParam("snapshot")); !requested {
+			return
+		}
+		if envSnapshotRepo == "" {
+			err = echo.NewHTTPError(http.StatusBadRequest, "snapshot requested but KB_SNAPSHOT_REPO is not configured")
+			return
+		}
+		if name, err = snapshotIndex(c.Request().Context(), longClient, envSnapshotRepo, index); err != nil {
+			return
+		}
+		logger.Info("index snapshotted", "index", index, "repository", envSnapshotRepo, "snapshot", name)
+		return
+	}
+	// bootstrap the first index with predefined mappings
+	e.POST("/admin/init", func(c echo.Context) (err error) {
+		ctx := c.Request().Context()
+		var indices []IndexRev
+		if indices, err = discoverIndices(ctx, client, envIndexPrefix); err != nil {
+			return
+		}
+		// without existing indices, discoverIndices returns the not yet created first index
+		first := indices[0]
+		var exists bool
+		if exists, err = client.IndexExists(first.Index).Do(ctx); err != nil {
+			return
+		}
+		if exists {
+			return c.String(http.StatusConflict, "index "+first.Index+" already exists")
+		}
+		defer indexCache.Invalidate()
+		if _, err = client.CreateIndex(first.Index).BodyJson(map[string]interface{}{
+			"mappings": indexMappings,
+		}).Do(ctx); err != nil {
+			return
+		}
+		return c.JSON(http.StatusCreated, map[string]interface{}{
+			"index": first.Index,
+		})
+	})
+	// create or update index template of revision indices with standard mappings
+	e.POST("/admin/template", func(c echo.Context) (err error) {
+		ctx, cancel := queryContext(c)
+		defer cancel()
+		if err = putIndexTemplate(ctx, client, envIndexPrefix, indexMappings); err != nil {
+			return
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"template": indexTemplateName(envIndexPrefix),
+			"pattern":  indexPattern,
+		})
+	})
+	e.POST("/admin/reindex", func(c echo.Context) (err error) {
+		var indices []IndexRev
+		if indices, err = discoverIndices(c.Request().Context(), client, envIndexPrefix); err != nil {
+			return
+		}
+		current := indices[0]
+		next := IndexRev{Index: envIndexPrefix + strconv.Itoa(current.Rev+1), Rev: current.Rev + 1}
+		var exists bool
+		if exists, err = client.IndexExists(next.Index).Do(c.Request().Context()); err != nil {
+			return
+		}
+		if exists {
+			return c.String(http.StatusConflict, "index "+next.Index+" already exists")
+		}
+		var snapshot string
+		if snapshot, err = snapshotBefore(c, current.Index); err != nil {
+			return
+		}
+		// without the active alias, the destination would become active as the highest revision while still
+		// being filled, so pin the alias to the source first, the destination is activated by /admin/promote
+		if envActiveRev == "" {
+			var aliases *elastic.AliasesResult
+			if aliases, err = client.Aliases().Index(envIndexPrefix + "*").Do(c.Request().Context()); err != nil {
+				return
+			}
+			if len(aliases.IndicesByAlias(activeAlias(envIndexPrefix))) == 0 {
+				if _, err = moveActiveAlias(c.Request().Context(), client, envIndexPrefix, current.Index); err != nil {
+					err = fmt.Errorf("failed to pin %s to %s: %w", activeAlias(envIndexPrefix), current.Index, err)
+					return
+				}
+				indexCache.Invalidate()
+			}
+		}
+		// step 1, create destination with settings and mappings of source, so field types survive
+		var body map[string]interface{}
+		if body, err = copyIndexBody(c.Request().Context(), client, current.Index); err != nil {
+			err = fmt.Errorf("failed to read settings and mappings of %s: %w", current.Index, err)
+			return
+		}
+		if _, err = client.CreateIndex(next.Index).BodyJson(body).Do(c.Request().Context()); err != nil {
+			err = fmt.Errorf("failed to create %s: %w", next.Index, err)
+			return
+		}
+		// step 2, copy documents
+		defer indexCache.Invalidate()
+		// with wait_for_completion=false, reindex runs as a task, poll /admin/reindex/status for progress
+		if wait, err := strconv.ParseBool(c.QueryParam("wait_for_completion")); err == nil && !wait {
+			var task *elastic.StartTaskResult
+			if task, err = client.Reindex().SourceIndex(current.Index).DestinationIndex(next.Index).
+				WaitForCompletion(false).DoAsync(c.Request().Context()); err != nil {
+				return err
+			}
+			return c.JSON(http.StatusAccepted, map[string]interface{}{
+				"source":      current.Index,
+				"destination": next.Index,
+				"task":        task.TaskId,
+				"snapshot":    snapshot,
+			})
+		}
+		var res *elastic.BulkIndexByScrollResponse
+		if res, err = longClient.Reindex().SourceIndex(current.Index).DestinationIndex(next.Index).Do(c.Request().Context()); err != nil {
+			return
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"source":      current.Index,
+			"destination": next.Index,
+			"took":        res.Took,
+			"total":       res.Total,
+			"created":     res.Created,
+			"updated":     res.Updated,
+			"failures":    len(res.Failures),
+			"snapshot":    snapshot,
+		})
+	})
+	e.GET("/admin/reindex/status", func(c echo.Context) (err error) {
+		taskID := strings.TrimSpace(c.QueryParam("task"))
+		if taskID == "" {
+			return c.String(http.StatusBadRequest, "missing task")
+		}
+		var res *elastic.TasksGetTaskResponse
+		if res, err = client.TasksGetTask().TaskId(taskID).Do(c.Request().Context()); err != nil {
+			if elastic.IsNotFound(err) {
+				return c.String(http.StatusNotFound, "task "+taskID+" not found")
+			}
+			return
+		}
+		var status struct {
+			Total   int64 `json:"total"`
+			Created int64 `json:"created"`
+			Updated int64 `json:"updated"`
+		}
+		if res.Task != nil && res.Task.Status != nil {
+			var buf []byte
+			if buf, err = json.Marshal(res.Task.Status); err != nil {
+				return
+			}
+			if err = json.Unmarshal(buf, &status); err != nil {
+				return
+			}
+		}
+		result := map[string]interface{}{
+			"task":      taskID,
+			"completed": res.Completed,
+			"total":     status.Total,
+			"created":   status.Created,
+			"updated":   status.Updated,
+		}
+		if res.Error != nil {
+			result["error"] = res.Error.Reason
+		}
+		return c.JSON(http.StatusOK, result)
+	})
+	// tokens and passwords are never exposed, only whether they are set
+	e.GET("/admin/config", func(c echo.Context) error {
+		var redactedURLs []string
+		for _, u := range urls {
+			if parsed, err := url.Parse(u); err == nil {
+				redactedURLs = append(redactedURLs, parsed.Redacted())
+			} else {
+				redactedURLs = append(redactedURLs, "(invalid url)")
+			}
+		}
+		var tokenLabels []string
+		for _, t := range accessTokens {
+			tokenLabels = append(tokenLabels, t.Label)
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"bind":                       envBind,
+			"debug":                      envDebug,
+			"tls":                        envTLSCert != "",
+			"gzip":                       envGzip,
+			"access_log":                 envAccessLog,
+			"access_token_labels":        tokenLabels,
+			"basic_auth":                 basicAuth.Enabled(),
+			"search_fields":              searchFields,
+			"search_preference":          searchPreference,
+			"elasticsearch_retries":      esRetries,
+			"elasticsearch_headers_set":  envESHeaders != "",
+			"history":                    envHistory,
+			"history_index":              envHistoryIndex,
+			"history_retention":          envHistoryRetention.String(),
+			"metrics_token_set":          envMetricsToken != "",
+			"cors_origins":               envCORSOrigins,
+			"index_prefix":               envIndexPrefix,
+			"active_rev":                 activeRev,
+			"index_cache_ttl":            envIndexCacheTTL.String(),
+			"views_dir":                  envViewsDir,
+			"kind_sort":                  envKindSort,
+			"kind_separator":             envKindSeparator,
+			"home_mode":                  envHomeMode,
+			"index_template":             envIndexTemplate,
+			"index_mappings_file":        envIndexMappingsFile,
+			"facet_size":                 envFacetSize,
+			"bulk_batch_size":            envBulkBatchSize,
+			"elasticsearch_urls":         redactedURLs,
+			"elasticsearch_username":     envElasticsearchUsername,
+			"elasticsearch_password_set": envElasticsearchPassword != "",
+			"elasticsearch_sniff":        envElasticsearchSniff,
+			"elasticsearch_healthcheck":  envElasticsearchHealthcheck,
+			"dial_retries":               envDialRetries,
+			"dial_retry_interval":        envDialRetryInterval.String(),
+			"health_timeout":             envHealthTimeout.String(),
+			"query_timeout":              envQueryTimeout.String(),
+			"request_timeout":            envRequestTimeout.String(),
+			"pretty_json":                envPrettyJSON,
+			"shutdown_timeout":           envShutdownTimeout.String(),
+		})
+	})
+	e.GET("/admin/indices", func(c echo.Context) (err error) {
+		ctx, cancel := queryContext(c)
+		defer cancel()
+		type Item struct {
+			Index     string `json:"index"`
+			Rev       int    `json:"rev"`
+			DocsCount int    `json:"docs_count"`
+			StoreSize string `json:"store_size"`
+			Active    bool   `json:"active"`
+		}
+		indexCache.Invalidate()
+		var indices []IndexRev
+		if indices, err = indexCache.Indices(ctx); err != nil {
+			return
+		}
+		var active IndexRev
+		if active, err = indexCache.ActiveRev(ctx); err != nil {
+			return
+		}
+		items := []Item{}
+		for _, index := range indices {
+			items = append(items, Item{
+				Index:     index.Index,
+				Rev:       index.Rev,
+				DocsCount: index.DocsCount,
+				StoreSize: index.StoreSize,
+				Active:    index.Index == active.Index,
+			})
+		}
+		return c.JSON(http.StatusOK, items)
+	})
+	e.DELETE("/admin/index/:rev", func(c echo.Context) (err error) {
+		ctx, cancel := queryContext(c)
+		defer cancel()
+		var rev int
+		if rev, err = strconv.Atoi(c.Param("rev")); err != nil || rev < 1 {
+			return c.String(http.StatusBadRequest, "invalid rev")
+		}
+		if c.QueryParam("confirm") != "true" {
+			return c.String(http.StatusBadRequest, "confirm=true is required")
+		}
+		index := envIndexPrefix + strconv.Itoa(rev)
+		var indices []IndexRev
+		if indices, err = discoverIndices(ctx, client, envIndexPrefix); err != nil {
+			return
+		}
+		if indices[0].Index == index {
+			return c.String(http.StatusConflict, "refuse to delete the highest revision "+index)
+		}
+		var aliases *elastic.AliasesResult
+		if aliases, err = client.Aliases().Index(envIndexPrefix + "*").Do(ctx); err != nil {
+			return
+		}
+		for _, active := range aliases.IndicesByAlias(activeAlias(envIndexPrefix)) {
+			if active == index {
+				return c.String(http.StatusConflict, "refuse to delete the active index "+index)
+			}
+		}
+		// the active index may also be pinned by KB_ACTIVE_REV
+		var active string
+		if active, err = indexCache.Active(ctx); err != nil {
+			return
+		}
+		if active == index {
+			return c.String(http.StatusConflict, "refuse to delete the active index "+index)
+		}
+		var snapshot string
+		if snapshot, err = snapshotBefore(c, index); err != nil {
+			if elastic.IsNotFound(err) {
+				return c.String(http.StatusNotFound, "index "+index+" not found")
+			}
+			return
+		}
+		if snapshot != "" {
+			// snapshot may have used up the query timeout
+			ctx, cancel = queryContext(c)
+			defer cancel()
+		}
+		defer indexCache.Invalidate()
+		if _, err = client.DeleteIndex(index).Do(ctx); err != nil {
+			if elastic.IsNotFound(err) {
+				return c.String(http.StatusNotFound, "index "+index+" not found")
+			}
+			return
+		}
+		logger.Info("index deleted", "index", index)
+		if snapshot != "" {
+			return c.JSON(http.StatusOK, map[string]interface{}{"index": index, "snapshot": snapshot})
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+	// make recently indexed documents searchable now, instead of waiting for refresh interval,
+	// all revisions are refreshed unless form value rev is given
+	e.POST("/admin/refresh", func(c echo.Context) (err error) {
+		ctx, cancel := queryContext(c)
+		defer cancel()
+		index := indexPattern
+		if v := strings.TrimSpace(c.FormValue("rev")); v != "" {
+			var rev int
+			if rev, err = strconv.Atoi(v); err != nil || rev < 1 {
+				return c.String(http.StatusBadRequest, "invalid rev")
+			}
+			index = envIndexPrefix + strconv.Itoa(rev)
+		}
+		var res *elastic.RefreshResult
+		if res, err = client.Refresh(index).Do(ctx); err != nil {
+			if elastic.IsNotFound(err) {
+				return c.String(http.StatusNotFound, "index "+index+" not found")
+			}
+			return
+		}
+		homeCache.Clear()
+		return c.JSON(http.StatusOK, map[string]interface{}{"index": index, "shards": res.Shards})
+	})
+	// banner is kept in memory only, KB_BANNER is restored on restart
+	e.POST("/admin/banner", func(c echo.Context) error {
+		banner := strings.TrimSpace(c.FormValue("banner"))
+		renderer.SetBanner(banner)
+		homeCache.Clear()
+		return c.JSON(http.StatusOK, map[string]interface{}{"banner": banner})
+	})
+	e.POST("/admin/alias", func(c echo.Context) (err error) {
+		ctx, cancel := queryContext(c)
+		defer cancel()
+		var rev int
+		if rev, err = strconv.Atoi(c.FormValue("rev")); err != nil || rev < 1 {
+			return c.String(http.StatusBadRequest, "invalid rev")
+		}
+		index := envIndexPrefix + strconv.Itoa(rev)
+		alias := activeAlias(envIndexPrefix)
+		var exists bool
+		if exists, err = client.IndexExists(index).Do(ctx); err != nil {
+			return
+		}
+		if !exists {
+			return c.String(http.StatusNotFound, "index "+index+" not found")
+		}
+		defer indexCache.Invalidate()
+		if _, err = moveActiveAlias(ctx, client, envIndexPrefix, index); err != nil {
+			return
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"alias": alias,
+			"index": index,
+		})
+	})
+	// blue/green deploy, switch reads to a reindexed revision after checking it's not empty
+	e.POST("/admin/promote/:rev", func(c echo.Context) (err error) {
+		ctx, cancel := queryContext(c)
+		defer cancel()
+		var rev int
+		if rev, err = strconv.Atoi(c.Param("rev")); err != nil || rev < 1 {
+			return c.String(http.StatusBadRequest, "invalid rev")
+		}
+		index := envIndexPrefix + strconv.Itoa(rev)
+		var exists bool
+		if exists, err = client.IndexExists(index).Do(ctx); err != nil {
+			return
+		}
+		if !exists {
+			return c.String(http.StatusNotFound, "index "+index+" not found")
+		}
+		var count int64
+		if count, err = client.Count(index).Do(ctx); err != nil {
+			return
+		}
+		if count == 0 {
+			return c.String(http.StatusConflict, "index "+index+" has no documents")
+		}
+		// without the alias, reads went to the highest revision
+		indexCache.Invalidate()
+		var before IndexRev
+		if before, err = indexCache.ActiveRev(ctx); err != nil {
+			return
+		}
+		defer indexCache.Invalidate()
+		if _, err = moveActiveAlias(ctx, client, envIndexPrefix, index); err != nil {
+			return
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"alias":          activeAlias(envIndexPrefix),
+			"previous_index": before.Index,
+			"previous_rev":   before.Rev,
+			"index":          index,
+			"rev":            rev,
+			"docs_count":     count,
+		})
+	})
+
+	chErr := make(chan error, 1)
+	chSig := make(chan os.Signal, 1)
+	signal.Notify(chSig, syscall.SIGTERM, syscall.SIGINT)
+	// SIGHUP reloads templates without restarting
+	chHup := make(chan os.Signal, 1)
+	signal.Notify(chHup, syscall.SIGHUP)
+	go func() {
+		for range chHup {
+			if err := renderer.Reload(envViewsDir); err != nil {
+				logger.Error("failed to reload templates", "error", err)
+				continue
+			}
+			logger.Info("templates reloaded", "dir", envViewsDir)
+		}
+	}()
+
+	go func() {
+		if envTLSCert != "" {
+			logger.Info("listening", "bind", envBind, "tls", true)
+			chErr <- e.StartTLS(envBind, envTLSCert, envTLSKey)
+		} else {
+			logger.Info("listening", "bind", envBind)
+			chErr <- e.Start(envBind)
+		}
+	}()
+
+	select {
+	case err = <-chErr:
+		return
+	case sig := <-chSig:
+		logger.Info("signal caught", "signal", sig, "in_flight", metrics.InFlight())
+		ctx, cancel := context.WithTimeout(context.Background(), envShutdownTimeout)
+		defer cancel()
+		// wait for in-flight requests to drain within shutdown timeout, then Shutdown waits for the rest
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+	drain:
+		for metrics.InFlight() > 0 {
+			select {
+			case <-ctx.Done():
+				logger.Warn("in-flight requests not drained", "timeout", envShutdownTimeout, "in_flight", metrics.InFlight())
+				break drain
+			case <-ticker.C:
+			}
+		}
+		if err = e.Shutdown(ctx); err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				logger.Warn("shutdown timed out", "timeout", envShutdownTimeout, "in_flight", metrics.InFlight())
+			}
+			return
+		}
+		logger.Info("shutdown completed", "in_flight", metrics.InFlight())
 	}
 }
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var metricsBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type metricsRequestKey struct {
+	Method string
+	Route  string
+	Status int
+}
+
+type metricsLatency struct {
+	Buckets []uint64
+	Sum     float64
+	Count   uint64
+}
+
+// Metrics minimal prometheus collector, exposes in text exposition format
+type Metrics struct {
+	inFlight  int64
+	mu        sync.Mutex
+	requests  map[metricsRequestKey]uint64
+	latencies map[string]*metricsLatency
+	esUp      bool
+}
+
+// NewMetrics create a new Metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:  map[metricsRequestKey]uint64{},
+		latencies: map[string]*metricsLatency{},
+	}
+}
+
+// Middleware record request count and latency per route, and track requests in flight
+func (m *Metrics) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) (err error) {
+		atomic.AddInt64(&m.inFlight, 1)
+		defer atomic.AddInt64(&m.inFlight, -1)
+		start := time.Now()
+		// error is handled here so the final status is recorded, it must not be handled again by echo
+		if err = next(c); err != nil {
+			c.Error(err)
+			err = nil
+		}
+		m.Observe(c.Request().Method, matchedRoute(c), c.Response().Status, time.Since(start))
+		return
+	}
+}
+
+// unmatchedRoute route label of requests matching no route, raw paths would make label values unbounded
+const unmatchedRoute = "(unmatched)"
+
+// matchedRoute route of request, unmatchedRoute if it's served by not found or method not allowed handler
+func matchedRoute(c echo.Context) string {
+	h := reflect.ValueOf(c.Handler()).Pointer()
+	if h == reflect.ValueOf(echo.NotFoundHandler).Pointer() || h == reflect.ValueOf(echo.MethodNotAllowedHandler).Pointer() {
+		return unmatchedRoute
+	}
+	return c.Path()
+}
+
+// Observe record a finished request
+func (m *Metrics) Observe(method, route string, status int, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[metricsRequestKey{Method: method, Route: route, Status: status}]++
+	l := m.latencies[route]
+	if l == nil {
+		l = &metricsLatency{Buckets: make([]uint64, len(metricsBuckets))}
+		m.latencies[route] = l
+	}
+	seconds := latency.Seconds()
+	for i, b := range metricsBuckets {
+		if seconds <= b {
+			l.Buckets[i]++
+		}
+	}
+	l.Sum += seconds
+	l.Count++
+}
+
+// InFlight number of requests in flight
+func (m *Metrics) InFlight() int64 {
+	return atomic.LoadInt64(&m.inFlight)
+}
+
+// SetElasticsearchUp update the elasticsearch up gauge
+func (m *Metrics) SetElasticsearchUp(up bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.esUp = up
+}
+
+// WriteTo write all metrics in prometheus text exposition format
+func (m *Metrics) WriteTo(w io.Writer) (n int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var out []byte
+	out = append(out, "# HELP kbase_http_requests_total Total number of http requests.\n"...)
+	out = append(out, "# TYPE kbase_http_requests_total counter\n"...)
+	keys := make([]metricsRequestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Route != keys[j].Route {
+			return keys[i].Route < keys[j].Route
+		}
+		if keys[i].Method != keys[j].Method {
+			return keys[i].Method < keys[j].Method
+		}
+		return keys[i].Status < keys[j].Status
+	})
+	for _, k := range keys {
+		out = append(out, fmt.Sprintf(
+			"kbase_http_requests_total{method=%q,route=%q,status=\"%d\"} %d\n",
+			k.Method, k.Route, k.Status, m.requests[k],
+		)...)
+	}
+
+	out = append(out, "# HELP kbase_http_request_duration_seconds Latency of http requests.\n"...)
+	out = append(out, "# TYPE kbase_http_request_duration_seconds histogram\n"...)
+	routes := make([]string, 0, len(m.latencies))
+	for route := range m.latencies {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	for _, route := range routes {
+		l := m.latencies[route]
+		for i, b := range metricsBuckets {
+			out = append(out, fmt.Sprintf(
+				"kbase_http_request_duration_seconds_bucket{route=%q,le=%q} %d\n",
+				route, strconv.FormatFloat(b, 'f', -1, 64), l.Buckets[i],
+			)...)
+		}
+		out = append(out, fmt.Sprintf("kbase_http_request_duration_seconds_bucket{route=%q,le=\"+Inf\"} %d\n", route, l.Count)...)
+		out = append(out, fmt.Sprintf("kbase_http_request_duration_seconds_sum{route=%q} %g\n", route, l.Sum)...)
+		out = append(out, fmt.Sprintf("kbase_http_request_duration_seconds_count{route=%q} %d\n", route, l.Count)...)
+	}
+
+	out = append(out, "# HELP kbase_http_requests_in_flight Number of http requests in flight.\n"...)
+	out = append(out, "# TYPE kbase_http_requests_in_flight gauge\n"...)
+	out = append(out, fmt.Sprintf("kbase_http_requests_in_flight %d\n", m.InFlight())...)
+
+	out = append(out, "# HELP kbase_elasticsearch_up Whether elasticsearch cluster is healthy.\n"...)
+	out = append(out, "# TYPE kbase_elasticsearch_up gauge\n"...)
+	if m.esUp {
+		out = append(out, "kbase_elasticsearch_up 1\n"...)
+	} else {
+		out = append(out, "kbase_elasticsearch_up 0\n"...)
+	}
+
+	var c int
+	c, err = w.Write(out)
+	n = int64(c)
+	return
+}
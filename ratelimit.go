@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type rateLimitBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// RateLimiter token bucket rate limiter keyed by client ip
+type RateLimiter struct {
+	rate    float64
+	burst   float64
+	mu      sync.Mutex
+	buckets map[string]*rateLimitBucket
+	swept   time.Time
+}
+
+// NewRateLimiter create a new RateLimiter, allows rate requests per second with burst per client
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: map[string]*rateLimitBucket{},
+		swept:   time.Now(),
+	}
+}
+
+// Allow take a token for key, returns false if bucket is empty
+func (rl *RateLimiter) Allow(key string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := time.Now()
+	// buckets idle long enough are full again, they are identical to absent ones
+	if now.Sub(rl.swept) > time.Minute {
+		for k, b := range rl.buckets {
+			if b.tokens+now.Sub(b.updated).Seconds()*rl.rate >= rl.burst {
+				delete(rl.buckets, k)
+			}
+		}
+		rl.swept = now
+	}
+	b := rl.buckets[key]
+	if b == nil {
+		b = &rateLimitBucket{tokens: rl.burst, updated: now}
+		rl.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.updated).Seconds() * rl.rate
+	if b.tokens > rl.burst {
+		b.tokens = rl.burst
+	}
+	b.updated = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Middleware reject requests exceeding rate limit with 429, skipped paths are not limited
+func (rl *RateLimiter) Middleware(skipped map[string]bool) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if skipped[c.Path()] {
+				return next(c)
+			}
+			if !rl.Allow(c.RealIP()) {
+				c.Response().Header().Set("Retry-After", "1")
+				return echo.NewHTTPError(http.StatusTooManyRequests, "too many requests")
+			}
+			return next(c)
+		}
+	}
+}
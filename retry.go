@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/olivere/elastic/v7"
+)
+
+// esRetries times to retry elasticsearch searches and gets rejected under pressure, configured by KB_ES_RETRY_429
+var esRetries = 2
+
+// isTransientError whether err is elasticsearch rejecting request under pressure, with 429 or 503
+func isTransientError(err error) bool {
+	return elastic.IsStatusCode(err, http.StatusTooManyRequests) || elastic.IsStatusCode(err, http.StatusServiceUnavailable)
+}
+
+// retryTransient call fn, retry up to esRetries times with exponential backoff while it fails with transient error
+func retryTransient(ctx context.Context, fn func() error) (err error) {
+	backoff := 100 * time.Millisecond
+	for i := 0; ; i++ {
+		if err = fn(); err == nil || i >= esRetries || !isTransientError(err) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// TimeoutMiddleware set an overall deadline on request context, skipped paths have no deadline.
+// handlers are not interrupted, elasticsearch queries derived from request context are cancelled
+// at the deadline, then the failed request is answered with 503
+func TimeoutMiddleware(timeout time.Duration, skipped map[string]bool) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if skipped[c.Path()] {
+				return next(c)
+			}
+			ctx, cancel := context.WithTimeout(c.Request().Context(), timeout)
+			defer cancel()
+			c.SetRequest(c.Request().WithContext(ctx))
+			err := next(c)
+			if err != nil && ctx.Err() == context.DeadlineExceeded && !c.Response().Committed {
+				return echo.NewHTTPError(http.StatusServiceUnavailable, "request timed out, please retry or narrow down the query")
+			}
+			return err
+		}
+	}
+}